@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	m20 "github.com/metrics20/go-metrics20"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// submitting metric documents to ES with the bulk API. elastigo's BulkIndexer can only index (replace) documents,
+// and doesn't tell us what happened to each of them, so we have our own. how a document is submitted depends on
+// the policy for its protocol:
+// create     only create documents that don't exist yet. if a document exists (a version conflict),
+//            it is left as it is, so whatever other tools added to it is kept.
+// merge      create the document, or update the existing one with our fields, keeping other fields.
+//            legacy metrics don't have tags, so their existing tags are kept as well.
+// overwrite  replace the document.
+//
+// we look at the result for every document. documents that failed for a reason that may go away (ES unreachable,
+// overloaded, or a conflict we couldn't resolve) are retried up to elasticsearch.max_retries times, with a backoff
+// that doubles every time. if that doesn't help, the ids are removed from the trackers' seen caches, so that they're
+// submitted again the next time they come in. documents that ES refuses (e.g. because they don't fit the mapping)
+// would be refused again, so they are written to elasticsearch.dead_letter_file instead.
+// once we shut down, we don't retry anymore, and all failed documents go to the dead letter file.
+
+type bulkIndexer struct {
+	conn       *esConnection
+	index      string
+	policy     string
+	schema     string
+	proto      int
+	maxDocs    int
+	maxDelay   time.Duration
+	maxRetries int
+	backoff    time.Duration
+
+	docs     chan bulkDoc
+	batches  chan []bulkDoc
+	pending  int64 // documents we have that ES hasn't acknowledged (or refused) yet. atomic
+	collects sync.WaitGroup
+	sends    sync.WaitGroup
+
+	indexed  stat // created, updated or replaced
+	existing stat // left alone because they existed already
+	retried  stat
+	failed   stat // gave up on them, or dead lettered
+}
+
+type bulkDoc struct {
+	id     string
+	action []byte
+	source []byte
+}
+
+// the parts of a bulk response we need
+type bulkResponse struct {
+	Errors bool                  `json:"errors"`
+	Items  []map[string]bulkItem `json:"items"` // action -> result
+}
+
+type bulkItem struct {
+	Id     string          `json:"_id"`
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"` // a string in older ES versions, an object in newer ones
+}
+
+// a line in the dead letter file
+type deadLetter struct {
+	Time   int64           `json:"time"`
+	Index  string          `json:"index"`
+	Id     string          `json:"id"`
+	Status int             `json:"status"` // 0 if we didn't get a response
+	Error  json.RawMessage `json:"error"`
+	Action json.RawMessage `json:"action"`
+	Source json.RawMessage `json:"source"`
+}
+
+var dead_letters struct {
+	sync.Mutex
+	path string
+	w    *bufio.Writer // nil if there's no dead letter file, in which case we drop them
+}
+
+// openDeadLetters opens the dead letter file for appending. path may be empty.
+func openDeadLetters(path string) error {
+	if path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	dead_letters.path = path
+	dead_letters.w = bufio.NewWriter(f)
+	return nil
+}
+
+// writeDeadLetters appends letters to the dead letter file
+func writeDeadLetters(letters []deadLetter) {
+	dead_letters.Lock()
+	defer dead_letters.Unlock()
+	if dead_letters.w == nil {
+		return
+	}
+	for _, letter := range letters {
+		line, _ := json.Marshal(letter)
+		dead_letters.w.Write(line)
+		dead_letters.w.WriteByte('\n')
+	}
+	err := dead_letters.w.Flush()
+	if err != nil {
+		fmt.Printf("WARN can't write to %s: %s. dropping failed documents from now on\n", dead_letters.path, err.Error())
+		dead_letters.w = nil
+	}
+}
+
+// NewBulkIndexer returns an indexer for the documents of a protocol. it has up to conns requests in flight,
+// each with up to maxDocs documents. documents are submitted at least every maxDelay.
+// failed documents are retried maxRetries times, the first time after backoff.
+func NewBulkIndexer(conn *esConnection, index, policy, schema string, proto, conns, maxDocs int, maxDelay time.Duration, maxRetries int, backoff time.Duration) *bulkIndexer {
+	return &bulkIndexer{
+		conn:       conn,
+		index:      index,
+		policy:     policy,
+		schema:     schema,
+		proto:      proto,
+		maxDocs:    maxDocs,
+		maxDelay:   maxDelay,
+		maxRetries: maxRetries,
+		backoff:    backoff,
+		docs:       make(chan bulkDoc, 100),
+		batches:    make(chan []bulkDoc, conns),
+		indexed:    NewCounter(fmt.Sprintf("unit_is_Doc.proto_is_%d.direction_is_out.type_is_indexed", proto), false),
+		existing:   NewCounter(fmt.Sprintf("unit_is_Doc.proto_is_%d.direction_is_out.type_is_existing", proto), false),
+		retried:    NewCounter(fmt.Sprintf("unit_is_Doc.proto_is_%d.direction_is_out.type_is_retried", proto), false),
+		failed:     NewCounter(fmt.Sprintf("unit_is_Err.orig_unit_is_Doc.proto_is_%d.direction_is_out.type_is_index_failed", proto), false),
+	}
+}
+
+func (b *bulkIndexer) Start() {
+	b.collects.Add(1)
+	go b.collect()
+	for i := 0; i < cap(b.batches); i++ {
+		b.sends.Add(1)
+		go b.send()
+	}
+}
+
+// Stop submits what we have, and returns once ES has responded. there must be no more calls to Index.
+func (b *bulkIndexer) Stop() {
+	close(b.docs)
+	b.collects.Wait()
+	close(b.batches)
+	b.sends.Wait()
+}
+
+func (b *bulkIndexer) PendingDocuments() int {
+	return int(atomic.LoadInt64(&b.pending))
+}
+
+// Index submits the document for a metric, in our schema, as the policy says. metric is nil for legacy metrics.
+func (b *bulkIndexer) Index(id string, metric *m20.MetricSpec) error {
+	var action, source interface{}
+	doc, partial := metricDocs(b.schema, id, metric)
+	meta := map[string]interface{}{"_index": b.index, "_type": "metric", "_id": id}
+	switch b.policy {
+	case "create":
+		meta["_timestamp"] = time.Now().UnixNano() / 1e6
+		action = map[string]interface{}{"create": meta}
+		source = doc
+	case "merge":
+		meta["retry_on_conflict"] = 3
+		action = map[string]interface{}{"update": meta}
+		source = map[string]interface{}{"doc": partial, "upsert": doc}
+	default:
+		meta["_timestamp"] = time.Now().UnixNano() / 1e6
+		action = map[string]interface{}{"index": meta}
+		source = doc
+	}
+	return b.add(id, action, source)
+}
+
+// IndexSource submits a document with the given source as is, replacing the existing one. for copying documents.
+func (b *bulkIndexer) IndexSource(id string, source json.RawMessage) error {
+	meta := map[string]interface{}{"_index": b.index, "_type": "metric", "_id": id}
+	return b.add(id, map[string]interface{}{"index": meta}, source)
+}
+
+func (b *bulkIndexer) add(id string, action, source interface{}) error {
+	actionLine, err := json.Marshal(action)
+	if err != nil {
+		return err
+	}
+	sourceLine, err := json.Marshal(source)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&b.pending, 1)
+	b.docs <- bulkDoc{id, actionLine, sourceLine}
+	return nil
+}
+
+// collect puts the documents in batches, which are handed to the senders when they're full, or every maxDelay
+func (b *bulkIndexer) collect() {
+	defer b.collects.Done()
+	ticker := time.NewTicker(b.maxDelay)
+	defer ticker.Stop()
+	var batch []bulkDoc
+	flush := func() {
+		if len(batch) > 0 {
+			b.batches <- batch
+			batch = nil
+		}
+	}
+	for {
+		select {
+		case doc, ok := <-b.docs:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, doc)
+			if len(batch) >= b.maxDocs {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// send submits batches, retrying the documents that can be retried
+func (b *bulkIndexer) send() {
+	defer b.sends.Done()
+	for batch := range b.batches {
+		for try := 0; len(batch) > 0; try++ {
+			if try > 0 {
+				time.Sleep(b.backoff << uint(try-1))
+				b.retried.Inc(int64(len(batch)))
+			}
+			batch = b.submit(batch, try < b.maxRetries && !isDraining())
+		}
+	}
+}
+
+// retryable tells whether a document that failed with the given status may succeed when retried.
+// 0 means we didn't get a response for it.
+func retryable(status int) bool {
+	return status == 0 || status == 409 || status == 429 || status >= 500
+}
+
+// submit sends a batch to ES and deals with the result for every document.
+// if retry is set, it returns the documents that should be retried.
+func (b *bulkIndexer) submit(batch []bulkDoc, retry bool) []bulkDoc {
+	var body bytes.Buffer
+	for _, doc := range batch {
+		body.Write(doc.action)
+		body.WriteByte('\n')
+		body.Write(doc.source)
+		body.WriteByte('\n')
+	}
+	items, err := b.post(&body, len(batch))
+	if err != nil {
+		fmt.Printf("WARN bulk request with %d documents for %s failed: %s\n", len(batch), b.index, err.Error())
+		msg, _ := json.Marshal(err.Error())
+		items = make([]bulkItem, len(batch))
+		for i := range items {
+			items[i] = bulkItem{Id: batch[i].id, Error: msg}
+		}
+	}
+	var retries []bulkDoc
+	var forget []string
+	var letters []deadLetter
+	for i, item := range items {
+		doc := batch[i]
+		switch {
+		case item.Status >= 200 && item.Status < 300:
+			b.indexed.Inc(1)
+		case item.Status == 409 && b.policy == "create":
+			b.existing.Inc(1)
+		case retryable(item.Status) && retry:
+			retries = append(retries, doc)
+		default:
+			b.failed.Inc(1)
+			if isVerbose() {
+				fmt.Printf("can't index %s: %d %s\n", doc.id, item.Status, string(item.Error))
+			}
+			if retryable(item.Status) && !isDraining() {
+				forget = append(forget, doc.id)
+			} else {
+				letters = append(letters, deadLetter{time.Now().Unix(), b.index, doc.id, item.Status, item.Error, doc.action, doc.source})
+			}
+		}
+	}
+	if len(forget) > 0 {
+		fmt.Printf("WARN gave up on %d documents for %s after %d retries\n", len(forget), b.index, b.maxRetries)
+		b.forget(forget)
+	}
+	if len(letters) > 0 {
+		fmt.Printf("WARN %d documents for %s failed for good. writing them to the dead letter file, if any\n", len(letters), b.index)
+		writeDeadLetters(letters)
+	}
+	atomic.AddInt64(&b.pending, -int64(len(batch)-len(retries)))
+	return retries
+}
+
+// post sends a bulk request with num documents, and returns the result for each of them
+func (b *bulkIndexer) post(body *bytes.Buffer, num int) ([]bulkItem, error) {
+	resp, err := b.conn.get().DoCommand("POST", "/_bulk", nil, body)
+	if err != nil {
+		return nil, err
+	}
+	var bulk bulkResponse
+	err = json.Unmarshal(resp, &bulk)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse response: %s", err.Error())
+	}
+	if len(bulk.Items) != num {
+		return nil, fmt.Errorf("response has %d items, not %d", len(bulk.Items), num)
+	}
+	items := make([]bulkItem, num)
+	for i, result := range bulk.Items {
+		for _, item := range result {
+			items[i] = item
+		}
+	}
+	return items, nil
+}
+
+// forget has the trackers remove ids from their seen caches
+func (b *bulkIndexer) forget(ids []string) {
+	if b.proto == 1 {
+		forgetShards(proto1_shards, ids)
+	} else {
+		forgetShards(proto2_shards, ids)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	m20 "github.com/metrics20/go-metrics20"
+	"github.com/vimeo/carbon-tagger/_third_party/github.com/Dieterbe/go-metrics"
+	elastigo "github.com/vimeo/carbon-tagger/_third_party/github.com/mattbaird/elastigo/lib"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBulkIndexer returns a proto1 bulk indexer like NewBulkIndexer does, but without registering its stats
+func testBulkIndexer(conn *elastigo.Conn, policy string, maxRetries int) *bulkIndexer {
+	return &bulkIndexer{
+		conn:       newEsConnection(conn),
+		index:      "metrics",
+		policy:     policy,
+		schema:     "flat",
+		proto:      1,
+		maxDocs:    2,
+		maxDelay:   10 * time.Millisecond,
+		maxRetries: maxRetries,
+		backoff:    time.Millisecond,
+		docs:       make(chan bulkDoc, 100),
+		batches:    make(chan []bulkDoc, 1),
+		indexed:    stat{val: metrics.NewCounter()},
+		existing:   stat{val: metrics.NewCounter()},
+		retried:    stat{val: metrics.NewCounter()},
+		failed:     stat{val: metrics.NewCounter()},
+	}
+}
+
+// forgotten returns the ids the shards were told to forget
+func forgotten(shards []*trackerShard) []string {
+	var ids []string
+	for _, shard := range shards {
+		shard.forgetLock.Lock()
+		ids = append(ids, shard.forgotten...)
+		shard.forgetLock.Unlock()
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// bulkES is a fake ES that answers bulk requests with the status that status gives every document
+type bulkES struct {
+	sync.Mutex
+	actions []string // action and id of every document we got
+}
+
+func (es *bulkES) serve(t *testing.T, status func(id string) int) (*elastigo.Conn, *httptest.Server) {
+	return fakeES(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_bulk" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		var items []string
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var action map[string]struct {
+				Id string `json:"_id"`
+			}
+			err := json.Unmarshal(scanner.Bytes(), &action)
+			if err != nil {
+				t.Errorf("invalid action line %q: %s", scanner.Text(), err)
+				return
+			}
+			scanner.Scan() // the source
+			for name, meta := range action {
+				es.Lock()
+				es.actions = append(es.actions, name+" "+meta.Id)
+				es.Unlock()
+				items = append(items, fmt.Sprintf(`{"%s":{"_id":"%s","status":%d}}`, name, meta.Id, status(meta.Id)))
+			}
+		}
+		fmt.Fprintf(w, `{"errors":true,"items":[%s]}`, strings.Join(items, ","))
+	})
+}
+
+func TestBulkIndexer(t *testing.T) {
+	var es bulkES
+	conn, srv := es.serve(t, func(id string) int {
+		switch id {
+		case "exists":
+			return 409
+		case "invalid":
+			return 400
+		}
+		return 201
+	})
+	defer srv.Close()
+
+	b := testBulkIndexer(conn, "create", 0)
+	b.Start()
+	for _, id := range []string{"a.b.c", "exists", "d.e.f", "invalid", "g.h.i"} {
+		b.Index(id, nil)
+	}
+	b.Stop()
+	if b.indexed.Count() != 3 || b.existing.Count() != 1 || b.failed.Count() != 1 {
+		t.Errorf("%d indexed, %d existing and %d failed, want 3, 1 and 1", b.indexed.Count(), b.existing.Count(), b.failed.Count())
+	}
+	if b.PendingDocuments() != 0 {
+		t.Errorf("%d documents pending after Stop", b.PendingDocuments())
+	}
+	want := "create a.b.c,create exists,create d.e.f,create invalid,create g.h.i"
+	es.Lock()
+	defer es.Unlock()
+	if got := strings.Join(es.actions, ","); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+// documents are retried while ES is unavailable. if that doesn't help, the trackers forget them
+func TestBulkIndexerDown(t *testing.T) {
+	conn, srv := fakeES(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	})
+	defer srv.Close()
+	defer func(orig []*trackerShard) { proto1_shards = orig }(proto1_shards)
+	proto1_shards = benchShards(1, 2)
+
+	b := testBulkIndexer(conn, "create", 2)
+	b.Start()
+	for _, id := range []string{"a.b.c", "d.e.f", "g.h.i"} {
+		b.Index(id, nil)
+	}
+	b.Stop()
+	if b.indexed.Count() != 0 || b.retried.Count() != 6 || b.failed.Count() != 3 || b.PendingDocuments() != 0 {
+		t.Errorf("%d indexed, %d retried, %d failed and %d pending, want 0, 6, 3 and 0", b.indexed.Count(), b.retried.Count(), b.failed.Count(), b.PendingDocuments())
+	}
+	if ids := forgotten(proto1_shards); strings.Join(ids, " ") != "a.b.c d.e.f g.h.i" {
+		t.Errorf("trackers were told to forget %v", ids)
+	}
+}
+
+// documents that are rejected for a reason that may go away are retried. those that fail for good are dead lettered
+func TestBulkIndexerRetry(t *testing.T) {
+	f, err := ioutil.TempFile("", "dead")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	err = openDeadLetters(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		dead_letters.w = nil
+	}()
+
+	var es bulkES
+	tries := make(map[string]int)
+	conn, srv := es.serve(t, func(id string) int {
+		tries[id]++
+		switch {
+		case id == "busy" && tries[id] == 1:
+			return 429
+		case id == "invalid":
+			return 400
+		}
+		return 201
+	})
+	defer srv.Close()
+
+	b := testBulkIndexer(conn, "create", 2)
+	b.Start()
+	for _, id := range []string{"busy", "invalid"} {
+		b.Index(id, nil)
+	}
+	b.Stop()
+	if b.indexed.Count() != 1 || b.retried.Count() != 1 || b.failed.Count() != 1 {
+		t.Errorf("%d indexed, %d retried and %d failed, want 1, 1 and 1", b.indexed.Count(), b.retried.Count(), b.failed.Count())
+	}
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var letter deadLetter
+	err = json.Unmarshal(data, &letter)
+	if err != nil {
+		t.Fatalf("invalid dead letter file %q: %s", data, err)
+	}
+	if letter.Id != "invalid" || letter.Status != 400 || letter.Index != "metrics" || string(letter.Source) != `{"tags":[]}` {
+		t.Errorf("got dead letter %q", data)
+	}
+}
+
+func TestBulkIndexerPolicies(t *testing.T) {
+	metric := &m20.MetricSpec{Id: "unit_is_B", Tags: map[string]string{"unit": "B"}}
+	cases := []struct {
+		policy, action, source string
+	}{
+		{"create", `"create":{"_id":"m","_index":"metrics","_timestamp":`, `{"tags":["unit=B"]}`},
+		{"merge", `{"update":{"_id":"m","_index":"metrics","_type":"metric","retry_on_conflict":3}}`, `{"doc":{"tags":["unit=B"]},"upsert":{"tags":["unit=B"]}}`},
+		{"overwrite", `"index":{"_id":"m","_index":"metrics","_timestamp":`, `{"tags":["unit=B"]}`},
+	}
+	for _, c := range cases {
+		b := testBulkIndexer(nil, c.policy, 0)
+		b.Index("m", metric)
+		d := <-b.docs
+		if d.id != "m" || !strings.Contains(string(d.action), c.action) || string(d.source) != c.source {
+			t.Errorf("%s: got %s, %s and %s, want m, %s and %s", c.policy, d.id, d.action, d.source, c.action, c.source)
+		}
+	}
+	// with merge, a legacy metric has no tags to update
+	b := testBulkIndexer(nil, "merge", 0)
+	b.Index("a.b.c", nil)
+	if source := string((<-b.docs).source); source != `{"doc":{},"upsert":{"tags":[]}}` {
+		t.Errorf("merging a legacy metric gives %s", source)
+	}
+}
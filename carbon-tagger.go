@@ -4,18 +4,19 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
-	m20 "github.com/metrics20/go-metrics20"
 	"github.com/vimeo/carbon-tagger/_third_party/github.com/Dieterbe/go-metrics"
 	"github.com/vimeo/carbon-tagger/_third_party/github.com/Dieterbe/go-metrics/exp"
-	elastigo "github.com/vimeo/carbon-tagger/_third_party/github.com/mattbaird/elastigo/lib"
 	"github.com/vimeo/carbon-tagger/_third_party/github.com/stvp/go-toml-config"
 	"io"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path"
 	"runtime/pprof"
-	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -26,33 +27,126 @@ func dieIfError(err error) {
 	}
 }
 
+// verbose is 1 with -verbose or the verbose setting. it changes on reload, so use isVerbose and setVerbose
+var verbose int32
+
+func isVerbose() bool {
+	return atomic.LoadInt32(&verbose) == 1
+}
+
+func setVerbose(v bool) {
+	var i int32
+	if v {
+		i = 1
+	}
+	atomic.StoreInt32(&verbose, i)
+}
+
 var (
-	verbose    bool
 	cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
 	memprofile = flag.String("memprofile", "", "write memory profile to this file")
 	configFile = flag.String("config", "carbon-tagger.conf", "config file")
 
+	verbose_flag bool
+
 	es_host         = config.String("elasticsearch.host", "undefined")
 	es_port         = config.Int("elasticsearch.port", 9200)
 	es_index_name   = config.String("elasticsearch.index", "graphite_metrics2")
 	es_flush_int    = config.Int("elasticsearch.flush_interval", 2)
 	es_max_backlog  = config.Int("elasticsearch.max_backlog", 1000) // if this many is in transit to indexer, start blocking
 	es_max_pending  = config.Int("elasticsearch.max_pending", 500)
+	es_cache_dir    = config.String("elasticsearch.cache_dir", "")
+	es_cache_snap   = config.Int("elasticsearch.cache_snapshot_interval", 300)
+	es_legacy_pol   = config.String("elasticsearch.legacy_policy", "create")
+	es_tagged_pol   = config.String("elasticsearch.tagged_policy", "create")
+	es_max_retries  = config.Int("elasticsearch.max_retries", 3)
+	es_backoff      = config.Int("elasticsearch.retry_backoff", 500)
+	es_dead_letter  = config.String("elasticsearch.dead_letter_file", "")
+	es_schema       = config.String("elasticsearch.schema", "flat")
+	es_shards       = config.Int("elasticsearch.shards", 1)
+	es_replicas     = config.Int("elasticsearch.replicas", 1)
+	es_trackers     = config.Int("elasticsearch.trackers", 4)
+	es_seen_set     = config.String("elasticsearch.seen_set", "map")
+	es_seen_fp_rate = config.Float64("elasticsearch.seen_fp_rate", 0.0001)
+	es_warm         = config.String("elasticsearch.warm_cache", "off")
+	es_warm_timeout = config.Int("elasticsearch.warm_timeout", 300)
+	es_warm_max     = config.Int("elasticsearch.warm_max_ids", 10000000)
 	in_port         = config.Int("in.port", 2003)
+	in_udp_addr     = config.String("in.udp_addr", "")
+	in_udp_buffer   = config.Int("in.udp_buffer_size", 65536)
+	in_max_line     = config.Int("in.max_line_length", 4096)
+	in_max_conns    = config.Int("in.max_connections", 0)
+	in_idle_timeout = config.Int("in.idle_timeout", 0)
+	in_tokenizer    = config.String("in.tokenizer", "strict")
+	in_udp_tok      = config.String("in.udp_tokenizer", "strict")
+	in_pickle_port  = config.Int("in.pickle_port", 0)
+	in_tagged_unit  = config.Bool("in.tagged_require_unit", false)
+	in_parsers      = config.Int("in.parsers", 4)
+	in_batch_size   = config.Int("in.batch_size", 100)
+	in_nonfinite    = config.String("in.nonfinite_values", "drop")
+	in_ts_window    = config.Int("in.timestamp_window", 0)
+	in_ts_policy    = config.String("in.timestamp_policy", "drop")
+	influx_port     = config.Int("influx.tcp_port", 0)
+	influx_http     = config.String("influx.http_addr", "")
+	influx_prec     = config.String("influx.precision", "ns")
+	influx_units    = config.String("influx.units", "")
+	influx_def_unit = config.String("influx.default_unit", "")
+	influx_forward  = config.Bool("influx.forward", true)
+	tsdb_port       = config.Int("opentsdb.port", 0)
+	tsdb_units      = config.String("opentsdb.units", "")
+	tsdb_def_unit   = config.String("opentsdb.default_unit", "")
+	tsdb_forward    = config.Bool("opentsdb.forward", true)
+	prom_http       = config.String("prometheus.http_addr", "")
+	prom_def_unit   = config.String("prometheus.default_unit", "")
+	prom_forward    = config.Bool("prometheus.forward", true)
+	out_dests       = config.String("out.destinations", "")
+	out_buffer_size = config.Int("out.buffer_size", 10000)
+	out_reconn_min  = config.Int("out.reconnect_min", 1)
+	out_reconn_max  = config.Int("out.reconnect_max", 30)
+	out_timeout     = config.Int("out.timeout", 5)
+	out_spool_dir   = config.String("out.spool_dir", "")
+	out_spool_seg   = config.Int("out.spool_segment_size", 64)
+	out_spool_max   = config.Int("out.spool_max_size", 1024)
+	out_routing     = config.String("out.routing", "all")
+	out_replication = config.Int("out.replication_factor", 1)
+	out_routes_file = config.String("out.routes_file", "")
 	stats_host      = config.String("stats.host", "localhost")
 	stats_port      = config.Int("stats.port", 2005)
 	stats_http_addr = config.String("stats.http_addr", "0.0.0.0:8123")
+	shutdown_secs   = config.Int("shutdown_timeout", 30)
+	cfg_verbose     = config.Bool("verbose", false)
 
 	stats_id             *string
 	stats_flush_interval *int
 
 	in_conns_current             stat
+	in_conns_rejected_total      stat
+	in_conns_idle_total          stat
+	in_lines_long_total          stat
 	in_conns_broken_total        stat
 	in_metrics_proto1_good_total stat
 	in_metrics_proto2_good_total stat
 	in_metrics_proto1_bad_total  stat
 	in_metrics_proto2_bad_total  stat
+	in_metrics_tagged_good_total stat
+	in_metrics_tagged_bad_total  stat
 	in_lines_bad_total           stat
+	in_value_bad_total           stat
+	in_ts_bad_total              stat
+	in_udp_packets_total         stat
+	in_udp_truncated_total       stat
+	in_udp_bad_total             stat
+	in_pickle_frames_total       stat
+	in_pickle_bad_total          stat
+	in_pickle_bad_paths_total    stat
+	in_influx_good_total         stat
+	in_influx_bad_total          stat
+	in_influx_skipped_total      stat
+	in_opentsdb_good_total       stat
+	in_opentsdb_bad_total        stat
+	in_prom_series_total         stat
+	in_prom_bad_total            stat
+	in_prom_skipped_total        stat
 	num_seen_proto2              stat
 	num_seen_proto1              stat
 	pending_backlog_proto1       stat // backlog in our queue (excl elastigo queue)
@@ -60,13 +154,11 @@ var (
 	pending_es_proto1            stat
 	pending_es_proto2            stat
 
-	lines_read  chan []byte
-	proto1_read chan string
-	proto2_read chan m20.MetricSpec
+	lines_read chan [][]byte
 )
 
 func init() {
-	flag.BoolVar(&verbose, "verbose", false, "print invalid lines and metrics")
+	flag.BoolVar(&verbose_flag, "verbose", false, "print invalid lines and metrics")
 }
 
 func main() {
@@ -89,57 +181,114 @@ func main() {
 	stats_flush_interval = config.Int("stats.flush_interval", 10)
 	err := config.Parse(*configFile)
 	dieIfError(err)
-
-	in_conns_current = NewGauge("unit_is_Conn.direction_is_in.type_is_open", false)
-	in_conns_broken_total = NewCounter("unit_is_Conn.direction_is_in.type_is_broken", false)
-	in_metrics_proto1_good_total = NewCounter("unit_is_Metric.proto_is_1.direction_is_in.type_is_good", false) // no thorough check
-	in_metrics_proto2_good_total = NewCounter("unit_is_Metric.proto_is_2.direction_is_in.type_is_good", false)
-	in_metrics_proto1_bad_total = NewCounter("unit_is_Err.orig_unit_is_Metric.type_is_invalid.proto_is_1.direction_is_in", false)
-	in_metrics_proto2_bad_total = NewCounter("unit_is_Err.orig_unit_is_Metric.type_is_invalid.proto_is_2.direction_is_in", false)
-	in_lines_bad_total = NewCounter("unit_is_Err.orig_unit_is_Msg.type_is_invalid_line.direction_is_in", false)
-	num_seen_proto1 = NewGauge("unit_is_Metric.proto_is_1.type_is_tracked", true)
-	num_seen_proto2 = NewGauge("unit_is_Metric.proto_is_2.type_is_tracked", true)
-	pending_backlog_proto1 = NewCounter("unit_is_Metric.proto_is_1.type_is_pending_in_backlog", true)
-	pending_backlog_proto2 = NewCounter("unit_is_Metric.proto_is_2.type_is_pending_in_backlog", true)
-	pending_es_proto1 = NewGauge("unit_is_Metric.proto_is_1.type_is_pending_in_es", true)
-	pending_es_proto2 = NewGauge("unit_is_Metric.proto_is_2.type_is_pending_in_es", true)
-
-	lines_read = make(chan []byte)
-	proto1_read = make(chan string, *es_max_backlog)
-	proto2_read = make(chan m20.MetricSpec, *es_max_backlog)
+	loaded_config, err = readConfigFile(*configFile)
+	dieIfError(err)
+	live_settings = startSettings()
+	setVerbose(verbose_flag || *cfg_verbose)
+	if !validPolicy(*in_nonfinite, "drop", "pass") {
+		dieIfError(fmt.Errorf("invalid in.nonfinite_values '%s'", *in_nonfinite))
+	}
+	if !validPolicy(*in_ts_policy, "drop", "clamp", "pass") {
+		dieIfError(fmt.Errorf("invalid in.timestamp_policy '%s'", *in_ts_policy))
+	}
+	if !validPolicy(*in_tokenizer, "strict", "lenient") {
+		dieIfError(fmt.Errorf("invalid in.tokenizer '%s'", *in_tokenizer))
+	}
+	if !validPolicy(*in_udp_tok, "strict", "lenient") {
+		dieIfError(fmt.Errorf("invalid in.udp_tokenizer '%s'", *in_udp_tok))
+	}
+	if !validPolicy(*es_legacy_pol, "create", "merge", "overwrite") {
+		dieIfError(fmt.Errorf("invalid elasticsearch.legacy_policy '%s'", *es_legacy_pol))
+	}
+	if !validPolicy(*es_tagged_pol, "create", "merge", "overwrite") {
+		dieIfError(fmt.Errorf("invalid elasticsearch.tagged_policy '%s'", *es_tagged_pol))
+	}
+	if !validPolicy(*es_schema, "flat", "structured") {
+		dieIfError(fmt.Errorf("invalid elasticsearch.schema '%s'", *es_schema))
+	}
+	if *es_trackers < 1 {
+		dieIfError(fmt.Errorf("invalid elasticsearch.trackers %d", *es_trackers))
+	}
+	if !validPolicy(*es_warm, "off", "background", "block") {
+		dieIfError(fmt.Errorf("invalid elasticsearch.warm_cache '%s'", *es_warm))
+	}
 
 	// connect to elasticsearch database to store tags
-	es := elastigo.NewConn()
-	es.Domain = *es_host
-	es.Port = strconv.Itoa(*es_port)
+	es := newEsConn(*es_host, *es_port)
+	es_conn = newEsConnection(es)
 
-	indexer1 := es.NewBulkIndexer(4)
-	indexer1.BulkMaxDocs = *es_max_pending
-	indexer1.BufferDelayMax = time.Duration(*es_flush_int) * time.Second
-	indexer1.Start()
+	switch flag.Arg(0) {
+	case "reconcile":
+		reconcile(es, flag.Args()[1:])
+		return
+	case "index":
+		manageIndex(es, flag.Args()[1:])
+		return
+	}
+	ensureIndex(es, *es_index_name)
 
-	indexer2 := es.NewBulkIndexer(4)
-	indexer1.BulkMaxDocs = *es_max_pending
-	indexer1.BufferDelayMax = time.Duration(*es_flush_int) * time.Second
-	indexer2.Start()
+	initStats()
 
-	go processInputLines()
-	// 1 worker, but ES library has multiple workers
-	go trackProto1(indexer1, *es_index_name)
-	go trackProto2(indexer2, *es_index_name)
+	lines_read = make(chan [][]byte, *in_parsers)
 
-	statsAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", *stats_host, *stats_port))
+	specs, err := parseDestinations(*out_dests)
+	dieIfError(err)
+	for _, spec := range specs {
+		dest := NewDestination(spec, *out_buffer_size)
+		if *out_spool_dir != "" {
+			dest.spool, err = NewSpool(path.Join(*out_spool_dir, statSafe(spec)), int64(*out_spool_seg)*1024*1024, int64(*out_spool_max)*1024*1024, statSafe(spec))
+			dieIfError(err)
+		}
+		destinations = append(destinations, dest)
+		go dest.run(time.Duration(*out_reconn_min)*time.Second, time.Duration(*out_reconn_max)*time.Second, time.Duration(*out_timeout)*time.Second)
+	}
+	if *out_routing != "all" {
+		ring, err = NewHashRing(*out_routing, destinations, *out_replication)
+		dieIfError(err)
+	}
+	if *out_routes_file != "" {
+		routes, err = parseRoutes(*out_routes_file, destinations)
+		dieIfError(err)
+		registerRouteStats(routes)
+	}
+	err = openDeadLetters(*es_dead_letter)
 	dieIfError(err)
-	go metrics.Graphite(metrics.DefaultRegistry, time.Duration(*stats_flush_interval)*time.Second, "", statsAddr)
 
-	// listen for incoming metrics
-	addr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf(":%d", *in_port))
+	// once the pipeline starts, signals must drain it rather than kill us, also while we're still starting up
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	flushInt := time.Duration(*es_flush_int) * time.Second
+	backoff := time.Duration(*es_backoff) * time.Millisecond
+	indexer1 := NewBulkIndexer(es_conn, *es_index_name, *es_legacy_pol, *es_schema, 1, 4, *es_max_pending, flushInt, *es_max_retries, backoff)
+	indexer1.Start()
+	indexer2 := NewBulkIndexer(es_conn, *es_index_name, *es_tagged_pol, *es_schema, 2, 4, *es_max_pending, flushInt, *es_max_retries, backoff)
+	indexer2.Start()
+
+	// the backlog is expressed in metrics, and spread over the trackers
+	proto1_shards, trackerStats1, err = newTrackerShards(1, *es_trackers, *es_max_backlog, *in_batch_size)
 	dieIfError(err)
-	listener, err := net.ListenTCP("tcp", addr)
+	proto2_shards, trackerStats2, err = newTrackerShards(2, *es_trackers, *es_max_backlog, *in_batch_size)
 	dieIfError(err)
-	defer listener.Close()
+	trackers.Add(2 * *es_trackers)
+	for i := 0; i < *es_trackers; i++ {
+		go trackProto1(proto1_shards[i], indexer1)
+		go trackProto2(proto2_shards[i], indexer2)
+	}
+	go serveTrackerStats(indexer1, indexer2)
+
+	parsers.Add(*in_parsers)
+	for i := 0; i < *in_parsers; i++ {
+		go processInputLines()
+	}
+
+	statsAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", *stats_host, *stats_port))
+	dieIfError(err)
+	go reportStats(statsConfig(statsAddr, *stats_flush_interval))
 	go func() {
 		exp.Exp(metrics.DefaultRegistry)
+		http.HandleFunc("/admin/reload", reloadHandler)
+		http.HandleFunc("/admin/seen", seenHandler)
 		fmt.Printf("carbon-tagger %s expvar web on %s\n", *stats_id, *stats_http_addr)
 		err := http.ListenAndServe(*stats_http_addr, nil)
 		if err != nil {
@@ -148,130 +297,213 @@ func main() {
 		}
 	}()
 
+	if *es_warm != "off" {
+		warmed := make(chan struct{})
+		timeout := time.Duration(*es_warm_timeout) * time.Second
+		go warmSeen(es, *es_index_name, timeout, *es_warm_max, warmed)
+		if *es_warm == "block" {
+			fmt.Println("warming seen caches from ES before accepting traffic")
+		warming:
+			for {
+				select {
+				case <-warmed:
+					break warming
+				case sig := <-sigs:
+					if handleSignal(sig, indexer1, indexer2) {
+						return
+					}
+				}
+			}
+		}
+	}
+
+	// listen for incoming metrics
+	addr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf(":%d", *in_port))
+	dieIfError(err)
+	listener, err := net.ListenTCP("tcp", addr)
+	dieIfError(err)
+	addCloser(listener)
+	if *in_udp_addr != "" {
+		udpAddr, err := net.ResolveUDPAddr("udp", *in_udp_addr)
+		dieIfError(err)
+		udpConn, err := net.ListenUDP("udp", udpAddr)
+		dieIfError(err)
+		addCloser(udpConn)
+		fmt.Printf("carbon-tagger %s listening on udp %s\n", *stats_id, *in_udp_addr)
+		acceptors.Add(1)
+		go handleUDP(udpConn, *in_udp_buffer)
+	}
+	if *in_pickle_port != 0 {
+		pickleAddr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf(":%d", *in_pickle_port))
+		dieIfError(err)
+		pickleListener, err := net.ListenTCP("tcp", pickleAddr)
+		dieIfError(err)
+		addCloser(pickleListener)
+		fmt.Printf("carbon-tagger %s listening for pickle on %d\n", *stats_id, *in_pickle_port)
+		acceptors.Add(1)
+		go listenPickle(pickleListener)
+	}
+	if *influx_port != 0 || *influx_http != "" {
+		influxUnits, err = parseUnitMapping(*influx_units)
+		dieIfError(err)
+	}
+	if *influx_port != 0 {
+		precision, ok := influxPrecisions[*influx_prec]
+		if !ok {
+			dieIfError(fmt.Errorf("invalid influx.precision '%s'", *influx_prec))
+		}
+		influxAddr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf(":%d", *influx_port))
+		dieIfError(err)
+		influxListener, err := net.ListenTCP("tcp", influxAddr)
+		dieIfError(err)
+		addCloser(influxListener)
+		fmt.Printf("carbon-tagger %s listening for influxdb line protocol on %d\n", *stats_id, *influx_port)
+		acceptors.Add(1)
+		go listenInfluxTCP(influxListener, precision)
+	}
+	if *influx_http != "" {
+		fmt.Printf("carbon-tagger %s influxdb /write endpoint on %s\n", *stats_id, *influx_http)
+		go listenInfluxHTTP(*influx_http)
+	}
+	if *tsdb_port != 0 {
+		opentsdbUnits, err = parseUnitMapping(*tsdb_units)
+		dieIfError(err)
+		tsdbAddr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf(":%d", *tsdb_port))
+		dieIfError(err)
+		tsdbListener, err := net.ListenTCP("tcp", tsdbAddr)
+		dieIfError(err)
+		addCloser(tsdbListener)
+		fmt.Printf("carbon-tagger %s listening for opentsdb on %d\n", *stats_id, *tsdb_port)
+		acceptors.Add(1)
+		go listenOpentsdb(tsdbListener)
+	}
+	if *prom_http != "" {
+		fmt.Printf("carbon-tagger %s prometheus remote write endpoint on %s\n", *stats_id, *prom_http)
+		go listenPromHTTP(*prom_http)
+	}
 	fmt.Printf("carbon-tagger %s listening on %d\n", *stats_id, *in_port)
+	acceptors.Add(1)
+	go listenTCP(listener)
+
+	for !handleSignal(<-sigs, indexer1, indexer2) {
+	}
+}
+
+// handleSignal reloads the config on SIGHUP, and shuts down on anything else. it returns whether we shut down.
+func handleSignal(sig os.Signal, indexers ...*bulkIndexer) bool {
+	if sig == syscall.SIGHUP {
+		report, err := reloadConfig()
+		if err != nil {
+			fmt.Printf("WARN config reload failed: %s\n", err.Error())
+		} else {
+			fmt.Printf("config reloaded\n%s", report)
+		}
+		return false
+	}
+	fmt.Printf("received %s. shutting down\n", sig)
+	shutdown(time.Duration(*shutdown_secs)*time.Second, indexers...)
+	return true
+}
+
+// initStats registers our internal metrics. stats_id must be set.
+func initStats() {
+	in_conns_current = NewGauge("unit_is_Conn.direction_is_in.type_is_open", false)
+	in_conns_rejected_total = NewCounter("unit_is_Conn.direction_is_in.type_is_rejected", false)
+	in_conns_idle_total = NewCounter("unit_is_Conn.direction_is_in.type_is_idle_timeout", false)
+	in_lines_long_total = NewCounter("unit_is_Err.orig_unit_is_Msg.type_is_too_long.direction_is_in", false)
+	in_conns_broken_total = NewCounter("unit_is_Conn.direction_is_in.type_is_broken", false)
+	in_metrics_proto1_good_total = NewCounter("unit_is_Metric.proto_is_1.direction_is_in.type_is_good", false) // no thorough check
+	in_metrics_proto2_good_total = NewCounter("unit_is_Metric.proto_is_2.direction_is_in.type_is_good", false)
+	in_metrics_proto1_bad_total = NewCounter("unit_is_Err.orig_unit_is_Metric.type_is_invalid.proto_is_1.direction_is_in", false)
+	in_metrics_proto2_bad_total = NewCounter("unit_is_Err.orig_unit_is_Metric.type_is_invalid.proto_is_2.direction_is_in", false)
+	in_metrics_tagged_good_total = NewCounter("unit_is_Metric.proto_is_tagged.direction_is_in.type_is_good", false)
+	in_metrics_tagged_bad_total = NewCounter("unit_is_Err.orig_unit_is_Metric.type_is_invalid.proto_is_tagged.direction_is_in", false)
+	in_lines_bad_total = NewCounter("unit_is_Err.orig_unit_is_Msg.type_is_invalid_line.direction_is_in", false)
+	in_value_bad_total = NewCounter("unit_is_Err.orig_unit_is_Metric.type_is_invalid_value.direction_is_in", false)
+	in_ts_bad_total = NewCounter("unit_is_Err.orig_unit_is_Metric.type_is_invalid_timestamp.direction_is_in", false)
+	in_udp_packets_total = NewCounter("unit_is_Pckt.transport_is_udp.direction_is_in.type_is_received", false)
+	in_udp_truncated_total = NewCounter("unit_is_Err.orig_unit_is_Pckt.type_is_truncated.transport_is_udp.direction_is_in", false)
+	in_udp_bad_total = NewCounter("unit_is_Err.orig_unit_is_Pckt.type_is_invalid.transport_is_udp.direction_is_in", false)
+	in_pickle_frames_total = NewCounter("unit_is_Msg.proto_is_pickle.direction_is_in.type_is_good", false)
+	in_pickle_bad_total = NewCounter("unit_is_Err.orig_unit_is_Msg.type_is_invalid.proto_is_pickle.direction_is_in", false)
+	in_pickle_bad_paths_total = NewCounter("unit_is_Err.orig_unit_is_Metric.type_is_invalid_path.proto_is_pickle.direction_is_in", false)
+	in_influx_good_total = NewCounter("unit_is_Msg.proto_is_influx.direction_is_in.type_is_good", false)
+	in_influx_bad_total = NewCounter("unit_is_Err.orig_unit_is_Msg.type_is_invalid_line.proto_is_influx.direction_is_in", false)
+	in_influx_skipped_total = NewCounter("unit_is_Metric.proto_is_influx.direction_is_in.type_is_skipped_field", false)
+	in_opentsdb_good_total = NewCounter("unit_is_Msg.proto_is_opentsdb.direction_is_in.type_is_good", false)
+	in_opentsdb_bad_total = NewCounter("unit_is_Err.orig_unit_is_Msg.type_is_invalid_line.proto_is_opentsdb.direction_is_in", false)
+	in_prom_series_total = NewCounter("unit_is_Metric.proto_is_prometheus.direction_is_in.type_is_good", false)
+	in_prom_bad_total = NewCounter("unit_is_Err.orig_unit_is_Req.type_is_invalid_request.proto_is_prometheus.direction_is_in", false)
+	in_prom_skipped_total = NewCounter("unit_is_Metric.proto_is_prometheus.direction_is_in.type_is_skipped_series", false)
+	num_seen_proto1 = NewGauge("unit_is_Metric.proto_is_1.type_is_tracked", true)
+	num_seen_proto2 = NewGauge("unit_is_Metric.proto_is_2.type_is_tracked", true)
+	pending_backlog_proto1 = NewCounter("unit_is_Metric.proto_is_1.type_is_pending_in_backlog", true)
+	pending_backlog_proto2 = NewCounter("unit_is_Metric.proto_is_2.type_is_pending_in_backlog", true)
+	pending_es_proto1 = NewGauge("unit_is_Metric.proto_is_1.type_is_pending_in_es", true)
+	pending_es_proto2 = NewGauge("unit_is_Metric.proto_is_2.type_is_pending_in_es", true)
+}
+
+func listenTCP(listener net.Listener) {
+	defer acceptors.Done()
 	for {
 		// would be nice to have a metric showing highest amount of connections seen per interval
 		conn_in, err := listener.Accept()
 		if err != nil {
+			if isDraining() {
+				return
+			}
 			fmt.Fprint(os.Stderr, err)
 			continue
 		}
+		if !admitConn(conn_in) {
+			continue
+		}
 		go handleClient(conn_in)
 	}
 }
 
 func handleClient(conn_in net.Conn) {
-	in_conns_current.Inc(1)
-	defer in_conns_current.Dec(1)
-	defer conn_in.Close()
+	defer releaseConn(conn_in)
 	reader := bufio.NewReader(conn_in)
+	batch := newLineBatcher(*in_batch_size, *in_tokenizer == "lenient")
 	for {
-		// TODO handle isPrefix cases (means we should merge this read with the next one in a different packet, i think)
-		buf, err := reader.ReadBytes('\n')
+		setIdleDeadline(conn_in)
+		buf, tooLong, err := readLine(reader, *in_max_line)
+		if tooLong {
+			if isVerbose() {
+				fmt.Printf("discarding line longer than %d bytes\n", *in_max_line)
+			}
+			in_lines_long_total.Inc(1)
+		}
 		if err != nil {
 			str := strings.TrimSpace(string(buf))
-			if err != io.EOF {
+			if err == io.EOF && len(str) > 0 {
+				// the client just didn't terminate its last line
+				batch.add(append(buf, '\n'))
+			}
+			batch.flush()
+			if isTimeout(err) && isDraining() {
+				// we're shutting down
+			} else if isTimeout(err) {
+				if isVerbose() {
+					fmt.Printf("closing connection from %s: idle for %ds\n", conn_in.RemoteAddr(), *in_idle_timeout)
+				}
+				in_conns_idle_total.Inc(1)
+			} else if err != io.EOF {
 				fmt.Printf("WARN connection closed uncleanly/broken: %s\n", err.Error())
 				in_conns_broken_total.Inc(1)
 			}
-			if len(str) > 0 {
-				// todo handle incomplete reads
+			if err != io.EOF && len(str) > 0 {
 				fmt.Printf("WARN incomplete read, line read: '%s'. neglecting line because connection closed because of %s\n", str, err.Error())
 			}
 			return
 		}
-		lines_read <- buf
-	}
-}
-
-func processInputLines() {
-	for buf := range lines_read {
-		str := strings.TrimSpace(string(buf))
-		elements := strings.Split(str, " ")
-		if len(elements) != 3 {
-			if verbose {
-				fmt.Println("line has !=3 elements:", str)
-			}
-			in_lines_bad_total.Inc(1)
-			continue
+		if !tooLong {
+			batch.add(buf)
 		}
-		id := elements[0]
-		if m20.IsMetric20(id) {
-			metric, err := m20.NewMetricSpec(id)
-			if err != nil {
-				if verbose {
-					fmt.Println(err)
-				}
-				in_metrics_proto2_bad_total.Inc(1)
-			} else {
-				in_metrics_proto2_good_total.Inc(1)
-				proto2_read <- *metric
-			}
-		} else {
-			err := m20.InitialValidation(id, m20.Legacy)
-			if err != nil {
-				if verbose {
-					fmt.Println(err)
-				}
-				in_metrics_proto1_bad_total.Inc(1)
-			} else {
-				in_metrics_proto1_good_total.Inc(1)
-				proto1_read <- elements[0]
-			}
-		}
-	}
-}
-
-func trackProto1(indexer *elastigo.BulkIndexer, index_name string) {
-	seenEs := make(map[string]bool)    // for ES. seen once = never need to resubmit
-	seenStats := make(map[string]bool) // for stats, provides "how many recently seen?"
-	for {
-		select {
-		case str := <-proto1_read:
-			seenStats[str] = true
-			if _, ok := seenEs[str]; ok {
-				continue
-			}
-			date := time.Now()
-			refresh := false // we can wait until the regular indexing runs
-			metric_es := m20.MetricEs{Tags: make([]string, 0)}
-			err := indexer.Index(index_name, "metric", str, "", &date, &metric_es, refresh)
-			dieIfError(err)
-			seenEs[str] = true
-		case <-num_seen_proto1.valueReq:
-			num_seen_proto1.valueResp <- int64(len(seenStats))
-			seenStats = make(map[string]bool)
-		case <-pending_backlog_proto1.valueReq:
-			pending_backlog_proto1.valueResp <- int64(len(proto1_read))
-		case <-pending_es_proto1.valueReq:
-			pending_es_proto1.valueResp <- int64(indexer.PendingDocuments())
-		}
-	}
-}
-
-func trackProto2(indexer *elastigo.BulkIndexer, index_name string) {
-	seenEs := make(map[string]bool)    // for ES. seen once = never need to resubmit
-	seenStats := make(map[string]bool) // for stats, provides "how many recently seen?"
-	for {
-		select {
-		case metric := <-proto2_read:
-			seenStats[metric.Id] = true
-			if _, ok := seenEs[metric.Id]; ok {
-				continue
-			}
-			date := time.Now()
-			refresh := false // we can wait until the regular indexing runs
-			metric_es := m20.NewMetricEs(metric)
-			err := indexer.Index(index_name, "metric", metric.Id, "", &date, &metric_es, refresh)
-			dieIfError(err)
-			seenEs[metric.Id] = true
-		case <-num_seen_proto2.valueReq:
-			num_seen_proto2.valueResp <- int64(len(seenStats))
-			seenStats = make(map[string]bool)
-		case <-pending_backlog_proto2.valueReq:
-			pending_backlog_proto2.valueResp <- int64(len(proto2_read))
-		case <-pending_es_proto2.valueReq:
-			pending_es_proto2.valueResp <- int64(indexer.PendingDocuments())
+		// don't hold on to lines while we wait for more data
+		if reader.Buffered() == 0 {
+			batch.flush()
 		}
 	}
 }
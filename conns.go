@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bookkeeping for incoming tcp connections, shared by all tcp listeners:
+// in.max_connections limits how many can be open at once (further ones are closed right away and counted),
+// and in.idle_timeout closes connections that don't send anything for a while.
+
+var (
+	num_conns  int64
+	open_conns = make(map[net.Conn]bool)
+	conns_lock sync.Mutex
+)
+
+// admitConn registers a new connection, or closes it if we're at the limit
+func admitConn(conn net.Conn) bool {
+	n := atomic.AddInt64(&num_conns, 1)
+	if *in_max_conns > 0 && n > int64(*in_max_conns) {
+		atomic.AddInt64(&num_conns, -1)
+		in_conns_rejected_total.Inc(1)
+		conn.Close()
+		return false
+	}
+	in_conns_current.Inc(1)
+	producers.Add(1)
+	conns_lock.Lock()
+	open_conns[conn] = true
+	conns_lock.Unlock()
+	return true
+}
+
+// releaseConn closes and unregisters an admitted connection
+func releaseConn(conn net.Conn) {
+	conn.Close()
+	conns_lock.Lock()
+	delete(open_conns, conn)
+	conns_lock.Unlock()
+	atomic.AddInt64(&num_conns, -1)
+	in_conns_current.Dec(1)
+	producers.Done()
+}
+
+// interruptConns gives all open connections a short while to finish reading, when we shut down
+func interruptConns() {
+	conns_lock.Lock()
+	defer conns_lock.Unlock()
+	for conn := range open_conns {
+		conn.SetReadDeadline(drainDeadline())
+	}
+}
+
+// setIdleDeadline is to be called before waiting for new data
+func setIdleDeadline(conn net.Conn) {
+	if *in_idle_timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(time.Duration(*in_idle_timeout) * time.Second))
+	}
+	// we may have started shutting down just now, so check after setting the idle deadline
+	if isDraining() {
+		conn.SetReadDeadline(drainDeadline())
+	}
+}
+
+// idleReader sets the idle deadline before every read, for connections that are read through a scanner or such
+type idleReader struct {
+	conn net.Conn
+}
+
+func (r idleReader) Read(p []byte) (int, error) {
+	setIdleDeadline(r.conn)
+	return r.conn.Read(p)
+}
+
+// isTimeout tells whether err is the result of a deadline
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
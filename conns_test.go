@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAdmitConn(t *testing.T) {
+	defer func(orig int) { *in_max_conns = orig }(*in_max_conns)
+	*in_max_conns = 2
+
+	rejected := in_conns_rejected_total.Count()
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, other := net.Pipe()
+		defer other.Close()
+		if admitConn(conn) != (i < 2) {
+			t.Fatalf("connection %d admitted: %v", i, i < 2)
+		}
+		conns = append(conns, conn)
+	}
+	if n := in_conns_rejected_total.Count() - rejected; n != 1 {
+		t.Errorf("%d connections rejected, want 1", n)
+	}
+	// the rejected connection is closed
+	if _, err := conns[2].Write([]byte("x")); err == nil {
+		t.Error("the rejected connection is still open")
+	}
+	releaseConn(conns[0])
+	conn, other := net.Pipe()
+	defer other.Close()
+	if !admitConn(conn) {
+		t.Error("no room after a connection was released")
+	}
+	releaseConn(conn)
+	releaseConn(conns[1])
+}
+
+func TestIdleTimeout(t *testing.T) {
+	defer func(orig int) { *in_idle_timeout = orig }(*in_idle_timeout)
+	*in_idle_timeout = 1
+
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+	start := time.Now()
+	_, err := idleReader{conn}.Read(make([]byte, 10))
+	if !isTimeout(err) {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+	if d := time.Since(start); d < time.Second || d > 5*time.Second {
+		t.Errorf("timed out after %s, want 1s", d)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	elastigo "github.com/vimeo/carbon-tagger/_third_party/github.com/mattbaird/elastigo/lib"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// management of the index: carbon-tagger [-config file] index create|delete|migrate [-yes]
+// on startup we create elasticsearch.index with our mapping if it doesn't exist. the mapping is versioned
+// (in its _meta, along with the schema of the documents), so we can tell when an index has an older one,
+// or documents of another schema than elasticsearch.schema. in that case, migrate creates an index
+// <index>_<schema>_v<version> with the current mapping, copies all documents into it (converting them to
+// the schema), and makes elasticsearch.index an alias for it, deleting the old index.
+// carbon-tagger should not be running while we migrate.
+// we also install an index template with the same mapping for <index>*, so that an index ES creates by itself,
+// because we write to it while it doesn't exist (it was deleted, or migrate is between deleting the old index
+// and adding the alias), gets our mapping rather than a dynamic one with analyzed tags.
+
+const indexMappingVersion = 1
+
+// indexBody returns the settings and mappings for a new index with documents of the given schema
+func indexBody(schema string) map[string]interface{} {
+	notAnalyzed := map[string]interface{}{"type": "string", "index": "not_analyzed"}
+	mapping := map[string]interface{}{
+		"_meta":   map[string]interface{}{"carbon_tagger_mapping_version": indexMappingVersion, "carbon_tagger_schema": schema},
+		"_source": map[string]interface{}{"enabled": true},
+		"_id":     map[string]interface{}{"index": "not_analyzed", "store": true},
+	}
+	if schema == "flat" {
+		mapping["properties"] = map[string]interface{}{"tags": notAnalyzed}
+	} else {
+		// whatever the tag keys are, their values are not analyzed strings
+		mapping["dynamic_templates"] = []interface{}{
+			map[string]interface{}{"tag_values": map[string]interface{}{"path_match": "tags.*", "mapping": notAnalyzed}},
+		}
+		mapping["properties"] = map[string]interface{}{
+			"tags":     map[string]interface{}{"type": "object"},
+			"tag_keys": notAnalyzed,
+			"id":       notAnalyzed,
+			"nodes":    map[string]interface{}{"type": "integer"},
+			"proto":    map[string]interface{}{"type": "integer"},
+		}
+	}
+	return map[string]interface{}{
+		"settings": map[string]interface{}{
+			"number_of_shards":   *es_shards,
+			"number_of_replicas": *es_replicas,
+		},
+		"mappings": map[string]interface{}{"metric": mapping},
+	}
+}
+
+// the parts of a get mapping response we need: concrete index -> type -> mapping
+type mappingResponse map[string]struct {
+	Mappings map[string]struct {
+		Meta map[string]interface{} `json:"_meta"`
+	} `json:"mappings"`
+}
+
+// indexInfo returns the concrete indices behind index (which is index itself, unless it's an alias),
+// the version of their mapping, which is 0 if we didn't create them, and the schema of their documents
+func indexInfo(conn *elastigo.Conn, index string) ([]string, int, string, error) {
+	body, err := conn.DoCommand("GET", "/"+index+"/_mapping", nil, nil)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	var resp mappingResponse
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return nil, 0, "", fmt.Errorf("can't parse mapping of %s: %s", index, err.Error())
+	}
+	var concrete []string
+	version := indexMappingVersion
+	schema := "flat" // what indices from before the schemas have
+	for name, mappings := range resp {
+		concrete = append(concrete, name)
+		meta := mappings.Mappings["metric"].Meta
+		v, _ := meta["carbon_tagger_mapping_version"].(float64)
+		if int(v) < version {
+			version = int(v)
+		}
+		if s, ok := meta["carbon_tagger_schema"].(string); ok {
+			schema = s
+		}
+	}
+	sort.Strings(concrete)
+	return concrete, version, schema, nil
+}
+
+func createIndex(conn *elastigo.Conn, index, schema string) error {
+	_, err := conn.DoCommand("PUT", "/"+index, nil, indexBody(schema))
+	return err
+}
+
+// putTemplate installs (or replaces) the index template for index and the indices migrate creates for it
+func putTemplate(conn *elastigo.Conn, index, schema string) error {
+	body := indexBody(schema)
+	body["template"] = index + "*"
+	_, err := conn.DoCommand("PUT", "/_template/carbon-tagger-"+index, nil, body)
+	return err
+}
+
+// ensureIndex creates the index if it doesn't exist, and warns if its mapping is outdated.
+// if ES can't be reached, we go on without.
+func ensureIndex(conn *elastigo.Conn, index string) {
+	exists, err := conn.IndicesExists(index)
+	if err != nil {
+		fmt.Printf("WARN can't check whether index %s exists: %s\n", index, err.Error())
+		return
+	}
+	err = putTemplate(conn, index, *es_schema)
+	if err != nil {
+		fmt.Printf("WARN can't install the index template for %s: %s\n", index, err.Error())
+	}
+	if !exists {
+		err = createIndex(conn, index, *es_schema)
+		if err != nil {
+			fmt.Printf("WARN can't create index %s: %s\n", index, err.Error())
+			return
+		}
+		fmt.Printf("created index %s with mapping version %d for the %s schema\n", index, indexMappingVersion, *es_schema)
+		return
+	}
+	_, version, schema, err := indexInfo(conn, index)
+	if err != nil {
+		fmt.Printf("WARN can't get the mapping of index %s: %s\n", index, err.Error())
+		return
+	}
+	if version < indexMappingVersion {
+		fmt.Printf("WARN index %s has mapping version %d, the current one is %d. see 'carbon-tagger index migrate'\n", index, version, indexMappingVersion)
+	}
+	if schema != *es_schema {
+		fmt.Printf("WARN index %s holds documents of the %s schema, not of elasticsearch.schema %s. see 'carbon-tagger index migrate'\n", index, schema, *es_schema)
+	}
+}
+
+// confirm asks the user to confirm an action, and exits if they don't
+func confirm(question string) {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if strings.TrimSpace(strings.ToLower(answer)) != "y" {
+		fmt.Println("cancelled")
+		os.Exit(1)
+	}
+}
+
+func manageIndex(conn *elastigo.Conn, args []string) {
+	flags := flag.NewFlagSet("index", flag.ExitOnError)
+	yes := flags.Bool("yes", false, "don't ask for confirmation")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: carbon-tagger [-config file] index create|delete|migrate [-yes]")
+		flags.PrintDefaults()
+	}
+	if len(args) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	flags.Parse(args[1:])
+	index := *es_index_name
+
+	switch args[0] {
+	case "create":
+		err := putTemplate(conn, index, *es_schema)
+		dieIfError(err)
+		err = createIndex(conn, index, *es_schema)
+		dieIfError(err)
+		fmt.Printf("created index %s with mapping version %d for the %s schema\n", index, indexMappingVersion, *es_schema)
+	case "delete":
+		concrete, _, _, err := indexInfo(conn, index)
+		dieIfError(err)
+		if !*yes {
+			confirm(fmt.Sprintf("delete index %s (%s) on %s:%d?", index, strings.Join(concrete, ", "), *es_host, *es_port))
+		}
+		for _, name := range concrete {
+			_, err = conn.DoCommand("DELETE", "/"+name, nil, nil)
+			dieIfError(err)
+			fmt.Printf("deleted index %s\n", name)
+		}
+	case "migrate":
+		migrateIndex(conn, index, *yes)
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+}
+
+// migrateIndex copies the documents of index into a new index with the current mapping and schema,
+// which index then becomes an alias of
+func migrateIndex(conn *elastigo.Conn, index string, yes bool) {
+	concrete, version, schema, err := indexInfo(conn, index)
+	dieIfError(err)
+	target := fmt.Sprintf("%s_%s_v%d", index, *es_schema, indexMappingVersion)
+	if version == indexMappingVersion && schema == *es_schema {
+		fmt.Printf("index %s already has mapping version %d for the %s schema\n", index, indexMappingVersion, schema)
+		return
+	}
+	if !yes {
+		confirm(fmt.Sprintf("copy index %s (%s, mapping version %d, %s schema) into %s, and replace it with an alias?", index, strings.Join(concrete, ", "), version, schema, target))
+	}
+	err = putTemplate(conn, index, *es_schema)
+	dieIfError(err)
+	err = createIndex(conn, target, *es_schema)
+	dieIfError(err)
+	fmt.Printf("created index %s with mapping version %d for the %s schema\n", target, indexMappingVersion, *es_schema)
+
+	copied, err := copyIndex(conn, index, target, schema, *es_schema)
+	if err != nil {
+		dieIfError(fmt.Errorf("can't copy %s into %s: %s. %s is left as it was, you may want to delete %s", index, target, err.Error(), index, target))
+	}
+	fmt.Printf("copied %d documents into %s\n", copied, target)
+
+	isAlias := len(concrete) != 1 || concrete[0] != index
+	var actions []interface{}
+	if isAlias {
+		for _, name := range concrete {
+			actions = append(actions, map[string]interface{}{"remove": map[string]string{"index": name, "alias": index}})
+		}
+	} else {
+		// an index and an alias can't have the same name, so there's a moment without either
+		_, err = conn.DoCommand("DELETE", "/"+index, nil, nil)
+		dieIfError(err)
+	}
+	actions = append(actions, map[string]interface{}{"add": map[string]string{"index": target, "alias": index}})
+	_, err = conn.DoCommand("POST", "/_aliases", nil, map[string]interface{}{"actions": actions})
+	dieIfError(err)
+	fmt.Printf("%s is now an alias for %s\n", index, target)
+	if isAlias {
+		for _, name := range concrete {
+			_, err = conn.DoCommand("DELETE", "/"+name, nil, nil)
+			dieIfError(err)
+			fmt.Printf("deleted index %s\n", name)
+		}
+	}
+}
+
+// copyIndex copies all documents from one index into another, converting them from one schema to another,
+// and returns how many it copied
+func copyIndex(conn *elastigo.Conn, from, to, fromSchema, toSchema string) (int, error) {
+	backoff := time.Duration(*es_backoff) * time.Millisecond
+	indexer := NewBulkIndexer(newEsConnection(conn), to, "overwrite", toSchema, 0, 4, *es_max_pending, time.Second, *es_max_retries, backoff)
+	indexer.Start()
+	args := map[string]interface{}{"scroll": "1m", "size": scrollPageSize}
+	query := map[string]interface{}{"query": map[string]interface{}{"match_all": map[string]interface{}{}}}
+	res, err := conn.Search(from, "metric", args, query)
+	copied := 0
+	for err == nil && len(res.Hits.Hits) > 0 {
+		for _, hit := range res.Hits.Hits {
+			source := json.RawMessage("{}")
+			if hit.Source != nil {
+				source = *hit.Source
+			}
+			source, err = convertSource(source, hit.Id, fromSchema, toSchema)
+			if err != nil {
+				err = fmt.Errorf("can't convert %s: %s", hit.Id, err.Error())
+				break
+			}
+			err = indexer.IndexSource(hit.Id, source)
+			if err != nil {
+				break
+			}
+			copied++
+		}
+		if err == nil {
+			res, err = conn.Scroll(map[string]interface{}{"scroll": "1m"}, res.ScrollId)
+		}
+	}
+	indexer.Stop()
+	if err != nil {
+		return copied, err
+	}
+	if failed := indexer.failed.Count(); failed > 0 {
+		return copied, fmt.Errorf("%d documents failed", failed)
+	}
+	return copied, nil
+}
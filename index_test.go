@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestIndexInfo(t *testing.T) {
+	cases := []struct {
+		mapping  string
+		concrete string
+		version  int
+		schema   string
+	}{
+		{`{"metrics":{"mappings":{"metric":{"properties":{}}}}}`, "metrics", 0, "flat"},
+		{`{"metrics_v1":{"mappings":{"metric":{"_meta":{"carbon_tagger_mapping_version":1}}}}}`, "metrics_v1", 1, "flat"},
+		{`{"metrics_structured_v1":{"mappings":{"metric":{"_meta":{"carbon_tagger_mapping_version":1,"carbon_tagger_schema":"structured"}}}}}`, "metrics_structured_v1", 1, "structured"},
+		// an alias for an index we created, and one we didn't
+		{`{"b":{"mappings":{"metric":{"_meta":{"carbon_tagger_mapping_version":1}}}},"a":{"mappings":{}}}`, "a,b", 0, "flat"},
+	}
+	for _, c := range cases {
+		conn, srv := fakeES(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/metrics/_mapping" {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, c.mapping)
+		})
+		concrete, version, schema, err := indexInfo(conn, "metrics")
+		srv.Close()
+		if err != nil {
+			t.Errorf("%s: %s", c.mapping, err)
+			continue
+		}
+		if strings.Join(concrete, ",") != c.concrete || version != c.version || schema != c.schema {
+			t.Errorf("%s: got %v, version %d and schema %s, want %s, version %d and schema %s", c.mapping, concrete, version, schema, c.concrete, c.version, c.schema)
+		}
+	}
+}
+
+// a missing index is created with our mapping. an existing one is left alone. either way, we install
+// the template for it
+func TestEnsureIndex(t *testing.T) {
+	for _, exists := range []bool{false, true} {
+		var lock sync.Mutex
+		var requests []string
+		bodies := make(map[string]map[string]interface{})
+		conn, srv := fakeES(t, func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			switch {
+			case r.Method == "HEAD" && !exists:
+				http.Error(w, "not found", http.StatusNotFound)
+			case r.Method == "PUT":
+				var body map[string]interface{}
+				data, _ := ioutil.ReadAll(r.Body)
+				err := json.Unmarshal(data, &body)
+				if err != nil {
+					t.Errorf("invalid body %q: %s", data, err)
+				}
+				bodies[r.URL.Path] = body
+				fmt.Fprint(w, `{"acknowledged":true}`)
+			case r.Method == "GET":
+				fmt.Fprintf(w, `{"metrics":{"mappings":{"metric":{"_meta":{"carbon_tagger_mapping_version":%d,"carbon_tagger_schema":"flat"}}}}}`, indexMappingVersion)
+			default:
+				fmt.Fprint(w, `{}`)
+			}
+		})
+		ensureIndex(conn, "metrics")
+		srv.Close()
+
+		want := "HEAD /metrics,PUT /_template/carbon-tagger-metrics,PUT /metrics"
+		if exists {
+			want = "HEAD /metrics,PUT /_template/carbon-tagger-metrics,GET /metrics/_mapping"
+		}
+		lock.Lock()
+		if got := strings.Join(requests, ","); got != want {
+			t.Errorf("index exists: %t: got %s, want %s", exists, got, want)
+		}
+		if template := bodies["/_template/carbon-tagger-metrics"]; template["template"] != "metrics*" || template["mappings"] == nil {
+			t.Errorf("index exists: %t: got template %v", exists, template)
+		}
+		if !exists {
+			body := bodies["/metrics"]
+			mappings, _ := body["mappings"].(map[string]interface{})
+			metric, _ := mappings["metric"].(map[string]interface{})
+			meta, _ := metric["_meta"].(map[string]interface{})
+			if meta["carbon_tagger_schema"] != *es_schema {
+				t.Errorf("index was created without the %s schema in its mapping: %v", *es_schema, body)
+			}
+		}
+		lock.Unlock()
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ingestion of the influxdb line protocol, over tcp (one point per line) and http (influxdb's /write endpoint).
+//
+//   measurement[,tag=value...] field=value[,field=value...] [timestamp]
+//
+// every numeric (or boolean) field becomes a metric 2.0, with the point's tags, plus measurement=<measurement>,
+// what=<field> and a unit, which comes from influx.units, the point's unit tag, or influx.default_unit.
+// string fields, and fields for which we have no unit, are skipped.
+// the metric is expressed as a graphite line using the key_is_value notation, which is either processed
+// like any incoming line (so it gets indexed and forwarded), or only indexed, based on influx.forward.
+
+var influxUnits map[string]string // field -> unit
+
+var influxPrecisions = map[string]int64{
+	"":   1,
+	"n":  1,
+	"ns": 1,
+	"u":  1e3,
+	"ms": 1e6,
+	"s":  1e9,
+	"m":  60e9,
+	"h":  3600e9,
+}
+
+// parseUnitMapping parses space separated field:unit pairs
+func parseUnitMapping(list string) (map[string]string, error) {
+	units := make(map[string]string)
+	for _, pair := range strings.Fields(list) {
+		kv := strings.SplitN(pair, ":", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid unit mapping '%s', need field:unit", pair)
+		}
+		units[kv[0]] = kv[1]
+	}
+	return units, nil
+}
+
+// splitUnescaped splits s on sep, except where sep is escaped with a backslash or inside double quotes
+// (if quotes is set). when n > 0, at most n parts are returned.
+func splitUnescaped(s string, sep byte, quotes bool, n int) []string {
+	var parts []string
+	start := 0
+	inQuote := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quotes && s[i] == '"':
+			inQuote = !inQuote
+		case s[i] == sep && !inQuote:
+			if n > 0 && len(parts) == n-1 {
+				break
+			}
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func unescapeInflux(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	return strings.NewReplacer(`\,`, ",", `\ `, " ", `\=`, "=", `\"`, `"`, `\\`, `\`).Replace(s)
+}
+
+// parseInfluxLine converts a line of influxdb line protocol into graphite lines.
+// precision is the amount of nanoseconds per timestamp unit
+func parseInfluxLine(line string, precision int64) ([]string, error) {
+	sections := splitUnescaped(line, ' ', true, 3)
+	if len(sections) < 2 {
+		return nil, errors.New("need at least measurement and fields")
+	}
+	key := splitUnescaped(sections[0], ',', false, 0)
+	measurement := unescapeInflux(key[0])
+	if measurement == "" {
+		return nil, errors.New("empty measurement")
+	}
+	tags := make(map[string]string)
+	for _, tag := range key[1:] {
+		kv := splitUnescaped(tag, '=', false, 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid tag '%s'", tag)
+		}
+		tags[unescapeInflux(kv[0])] = unescapeInflux(kv[1])
+	}
+	ts := time.Now().Unix()
+	if len(sections) == 3 && sections[2] != "" {
+		t, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp '%s'", sections[2])
+		}
+		ts = t * precision / 1e9
+	}
+	var out []string
+	for _, field := range splitUnescaped(sections[1], ',', true, 0) {
+		kv := splitUnescaped(field, '=', true, 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid field '%s'", field)
+		}
+		name, raw := unescapeInflux(kv[0]), kv[1]
+		var val string
+		switch {
+		case raw[0] == '"':
+			// strings can't be stored in graphite
+			in_influx_skipped_total.Inc(1)
+			continue
+		case raw == "t" || raw == "T" || raw == "true" || raw == "True" || raw == "TRUE":
+			val = "1"
+		case raw == "f" || raw == "F" || raw == "false" || raw == "False" || raw == "FALSE":
+			val = "0"
+		case strings.HasSuffix(raw, "i") || strings.HasSuffix(raw, "u"):
+			_, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid integer value '%s'", raw)
+			}
+			val = raw[:len(raw)-1]
+		default:
+			f, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value '%s'", raw)
+			}
+			val = strconv.FormatFloat(f, 'f', -1, 64)
+		}
+		unit, ok := influxUnits[name]
+		if !ok {
+			unit = tags["unit"]
+		}
+		if unit == "" {
+			unit = *influx_def_unit
+		}
+		if unit == "" {
+			if isVerbose() {
+				fmt.Printf("skipping influx field '%s' of '%s': no unit known\n", name, measurement)
+			}
+			in_influx_skipped_total.Inc(1)
+			continue
+		}
+		metricTags := make(map[string]string, len(tags)+3)
+		for k, v := range tags {
+			metricTags[k] = v
+		}
+		metricTags["measurement"] = measurement
+		metricTags["what"] = name
+		metricTags["unit"] = unit
+		out = append(out, fmt.Sprintf("%s %s %d", m20Id(metricTags), val, ts))
+	}
+	return out, nil
+}
+
+// handleInfluxLines parses and processes all lines from r. invalid lines are skipped,
+// the error for the last one is returned.
+func handleInfluxLines(r io.Reader, precision int64) error {
+	batch := newMetric20Batch(*influx_forward)
+	scanner := bufio.NewScanner(batchReader{r, batch})
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var lastErr error
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		lines, err := parseInfluxLine(line, precision)
+		if err != nil {
+			if isVerbose() {
+				fmt.Printf("invalid influx line '%s': %s\n", line, err.Error())
+			}
+			in_influx_bad_total.Inc(1)
+			lastErr = fmt.Errorf("unable to parse '%s': %s", line, err.Error())
+			continue
+		}
+		in_influx_good_total.Inc(1)
+		for _, l := range lines {
+			batch.add(l)
+		}
+	}
+	batch.flush()
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return lastErr
+}
+
+func listenInfluxTCP(listener net.Listener, precision int64) {
+	defer acceptors.Done()
+	for {
+		conn_in, err := listener.Accept()
+		if err != nil {
+			if isDraining() {
+				return
+			}
+			fmt.Fprint(os.Stderr, err)
+			continue
+		}
+		if !admitConn(conn_in) {
+			continue
+		}
+		go func(conn_in net.Conn) {
+			defer releaseConn(conn_in)
+			err := handleInfluxLines(idleReader{conn_in}, precision)
+			if isTimeout(err) {
+				in_conns_idle_total.Inc(1)
+			} else if err != nil && isVerbose() {
+				fmt.Printf("influx connection: %s\n", err.Error())
+			}
+		}(conn_in)
+	}
+}
+
+// influxWriteHandler implements influxdb's /write endpoint
+func influxWriteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	precision, ok := influxPrecisions[r.URL.Query().Get("precision")]
+	if !ok {
+		http.Error(w, `{"error":"invalid precision"}`, http.StatusBadRequest)
+		return
+	}
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	err := handleInfluxLines(body, precision)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error":%q}`, "partial write: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listenInfluxHTTP(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/write", influxWriteHandler)
+	err := serveHTTP(addr, mux)
+	if err != nil {
+		fmt.Println("Error opening influx http endpoint:", err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseInfluxLine(t *testing.T) {
+	defer func(orig map[string]string) { influxUnits = orig }(influxUnits)
+	influxUnits = map[string]string{"usage_idle": "Pct"}
+	cases := []struct {
+		line      string
+		precision int64
+		want      []string
+	}{
+		{
+			"cpu,host=web1 usage_idle=12.5,load=3i 1434000000000000000", 1,
+			// load has no unit, so it's skipped
+			[]string{"host_is_web1.measurement_is_cpu.unit_is_Pct.what_is_usage_idle 12.5 1434000000"},
+		},
+		{
+			`mem,host=a\ b,unit=B used=5i,free=7u,note="a b",ok=t 1434000000`, 1e9,
+			[]string{
+				"host_is_a_b.measurement_is_mem.unit_is_B.what_is_used 5 1434000000",
+				"host_is_a_b.measurement_is_mem.unit_is_B.what_is_free 7 1434000000",
+				"host_is_a_b.measurement_is_mem.unit_is_B.what_is_ok 1 1434000000",
+			},
+		},
+		{
+			`disk\,io,dev=sda.1,unit=B read=1e3 1434000000000`, 1e6,
+			[]string{"dev_is_sda_1.measurement_is_disk,io.unit_is_B.what_is_read 1000 1434000000"},
+		},
+	}
+	for _, c := range cases {
+		got, err := parseInfluxLine(c.line, c.precision)
+		if err != nil {
+			t.Errorf("%s: %s", c.line, err)
+			continue
+		}
+		if strings.Join(got, "\n") != strings.Join(c.want, "\n") {
+			t.Errorf("%s gives\n%s\nwant\n%s", c.line, strings.Join(got, "\n"), strings.Join(c.want, "\n"))
+		}
+	}
+}
+
+func TestParseInfluxLineInvalid(t *testing.T) {
+	for _, line := range []string{
+		"cpu",
+		",host=a value=1",
+		"cpu,host value=1",
+		"cpu,host= value=1",
+		"cpu value",
+		"cpu value=abc",
+		"cpu value=1.5i",
+		"cpu value=1 now",
+	} {
+		if _, err := parseInfluxLine(line, 1); err == nil {
+			t.Errorf("'%s' should be rejected", line)
+		}
+	}
+}
+
+func TestParseUnitMapping(t *testing.T) {
+	units, err := parseUnitMapping("usage_idle:Pct  bytes_sent:B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(units) != 2 || units["usage_idle"] != "Pct" || units["bytes_sent"] != "B" {
+		t.Fatalf("got units %v", units)
+	}
+	for _, list := range []string{"usage_idle", "usage_idle:", ":Pct"} {
+		if _, err := parseUnitMapping(list); err == nil {
+			t.Errorf("'%s' should be rejected", list)
+		}
+	}
+}
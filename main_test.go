@@ -0,0 +1,13 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	id := "test"
+	stats_id = &id
+	initStats()
+	os.Exit(m.Run())
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	m20 "github.com/metrics20/go-metrics20"
+	"io"
+	"sort"
+	"strings"
+)
+
+// helpers for the listeners that take metrics in other formats and convert them into metrics 2.0
+
+var (
+	// nodeSeparators are the characters that would split a node or a tag pair
+	nodeSeparators = strings.NewReplacer(".", "_", " ", "_", "=", "_", ";", "_")
+	// tagSeparator escapes the _is_ that separates key and value, which can show up
+	// in the input or after replacing the node separators (e.g. "a.is.b")
+	tagSeparator = strings.NewReplacer("_is_", "-is-")
+)
+
+// nodeSafe makes a string usable as (part of) a node in a graphite metric id,
+// without it containing "_is_", which would mess up the key_is_value pair
+func nodeSafe(s string) string {
+	return tagSeparator.Replace(nodeSeparators.Replace(s))
+}
+
+// keySafe is nodeSafe for a tag key, which can't end in "_is" either, or the
+// key_is_value pair would split too early
+func keySafe(s string) string {
+	s = nodeSafe(s)
+	if strings.HasSuffix(s, "_is") {
+		s = s[:len(s)-3] + "-is"
+	}
+	return s
+}
+
+// m20Id builds the key_is_value style metric id for a set of tags, with the tags sorted by key
+func m20Id(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	nodes := make([]string, len(keys))
+	for i, key := range keys {
+		nodes[i] = keySafe(key) + "_is_" + nodeSafe(tags[key])
+	}
+	return strings.Join(nodes, ".")
+}
+
+// metric20Batch collects converted graphite lines, and submits them in batches of in.batch_size, like the
+// line listeners do: to the parsers like any incoming line (so they also get forwarded), or, if forward is
+// not set, straight to the trackers, to only index them.
+type metric20Batch struct {
+	forward bool
+	lines   [][]byte
+	metrics []m20.MetricSpec
+}
+
+func newMetric20Batch(forward bool) *metric20Batch {
+	return &metric20Batch{forward: forward}
+}
+
+// add adds a converted line to the batch, and submits the batch when full
+func (b *metric20Batch) add(line string) {
+	if b.forward {
+		b.lines = append(b.lines, []byte(line+"\n"))
+		if len(b.lines) >= *in_batch_size {
+			b.flush()
+		}
+		return
+	}
+	id := line[:strings.IndexByte(line, ' ')]
+	metric, err := m20.NewMetricSpec(id)
+	if err != nil {
+		if isVerbose() {
+			fmt.Println(err)
+		}
+		in_metrics_proto2_bad_total.Inc(1)
+		return
+	}
+	in_metrics_proto2_good_total.Inc(1)
+	b.metrics = append(b.metrics, *metric)
+	if len(b.metrics) >= *in_batch_size {
+		b.flush()
+	}
+}
+
+// flush submits the lines or metrics collected so far
+func (b *metric20Batch) flush() {
+	if len(b.lines) > 0 {
+		lines_read <- b.lines
+		b.lines = nil
+	}
+	if len(b.metrics) > 0 {
+		submitProto2(b.metrics)
+		b.metrics = nil
+	}
+}
+
+// batchReader flushes the batch before every read from r, so that we don't hold on to lines
+// while we wait for more data
+type batchReader struct {
+	r     io.Reader
+	batch *metric20Batch
+}
+
+func (r batchReader) Read(p []byte) (int, error) {
+	r.batch.flush()
+	return r.r.Read(p)
+}
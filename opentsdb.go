@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ingestion of opentsdb's telnet protocol, as spoken by tcollector and friends:
+//
+//   put <metric> <timestamp> <value> <tagk1=tagv1 ...>
+//
+// every put becomes a metric 2.0 with the given tags, plus what=<metric> and a unit, which comes from the
+// longest matching prefix in opentsdb.units, the put's unit tag, or opentsdb.default_unit.
+// like with influx, the metric is expressed as a graphite line using the key_is_value notation, which is
+// either processed like any incoming line (so it gets indexed and forwarded), or only indexed.
+
+var opentsdbUnits map[string]string // metric prefix -> unit
+
+// opentsdbUnit returns the unit for a metric, based on the longest matching prefix
+func opentsdbUnit(metric string) string {
+	unit := ""
+	longest := -1
+	for prefix, u := range opentsdbUnits {
+		if len(prefix) > longest && strings.HasPrefix(metric, prefix) {
+			unit = u
+			longest = len(prefix)
+		}
+	}
+	return unit
+}
+
+// parseOpentsdbPut converts the arguments of a put command into a graphite line
+func parseOpentsdbPut(fields []string) (string, error) {
+	if len(fields) < 3 {
+		return "", errors.New("need metric, timestamp and value")
+	}
+	metric := fields[0]
+	ts, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || ts <= 0 {
+		return "", fmt.Errorf("invalid timestamp '%s'", fields[1])
+	}
+	if ts > 9999999999 {
+		// milliseconds
+		ts /= 1000
+	}
+	val, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid value '%s'", fields[2])
+	}
+	tags := make(map[string]string, len(fields))
+	for _, tag := range fields[3:] {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return "", fmt.Errorf("invalid tag '%s'", tag)
+		}
+		tags[kv[0]] = kv[1]
+	}
+	unit := opentsdbUnit(metric)
+	if unit == "" {
+		unit = tags["unit"]
+	}
+	if unit == "" {
+		unit = *tsdb_def_unit
+	}
+	if unit == "" {
+		return "", fmt.Errorf("no unit known for metric '%s'", metric)
+	}
+	tags["what"] = metric
+	tags["unit"] = unit
+	return fmt.Sprintf("%s %s %d", m20Id(tags), strconv.FormatFloat(val, 'f', -1, 64), ts), nil
+}
+
+func listenOpentsdb(listener net.Listener) {
+	defer acceptors.Done()
+	for {
+		conn_in, err := listener.Accept()
+		if err != nil {
+			if isDraining() {
+				return
+			}
+			fmt.Fprint(os.Stderr, err)
+			continue
+		}
+		if !admitConn(conn_in) {
+			continue
+		}
+		go handleOpentsdbClient(conn_in)
+	}
+}
+
+func handleOpentsdbClient(conn_in net.Conn) {
+	defer releaseConn(conn_in)
+	batch := newMetric20Batch(*tsdb_forward)
+	defer batch.flush()
+	scanner := bufio.NewScanner(batchReader{idleReader{conn_in}, batch})
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "put":
+			line, err := parseOpentsdbPut(fields[1:])
+			if err != nil {
+				if isVerbose() {
+					fmt.Printf("invalid opentsdb put '%s': %s\n", scanner.Text(), err.Error())
+				}
+				in_opentsdb_bad_total.Inc(1)
+				// like opentsdb, tell the client, but keep the connection open
+				fmt.Fprintf(conn_in, "put: illegal argument: %s\n", err.Error())
+				continue
+			}
+			in_opentsdb_good_total.Inc(1)
+			batch.add(line)
+		case "version":
+			// tcollector uses this to check whether the connection is still alive
+			fmt.Fprintf(conn_in, "carbon-tagger opentsdb listener\n")
+		case "exit":
+			return
+		default:
+			if isVerbose() {
+				fmt.Printf("unknown opentsdb command '%s'\n", fields[0])
+			}
+			in_opentsdb_bad_total.Inc(1)
+			fmt.Fprintf(conn_in, "unknown command: %s.\n", fields[0])
+		}
+	}
+	if err := scanner.Err(); isTimeout(err) {
+		in_conns_idle_total.Inc(1)
+	} else if err != nil {
+		fmt.Printf("WARN opentsdb connection closed uncleanly/broken: %s\n", err.Error())
+		in_conns_broken_total.Inc(1)
+	}
+}
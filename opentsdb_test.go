@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseOpentsdbPut(t *testing.T) {
+	defer func(orig map[string]string) { opentsdbUnits = orig }(opentsdbUnits)
+	opentsdbUnits = map[string]string{"sys.": "Pct", "sys.mem.": "B"}
+	cases := []struct {
+		put  string
+		want string
+	}{
+		{"sys.cpu.user 1434000000 12.5 host=web1", "host_is_web1.unit_is_Pct.what_is_sys_cpu_user 12.5 1434000000"},
+		// the longest prefix wins, and milliseconds become seconds
+		{"sys.mem.free 1434000000123 1024 host=web1 dc=ams", "dc_is_ams.host_is_web1.unit_is_B.what_is_sys_mem_free 1024 1434000000"},
+		{"app.requests 1434000000 5 unit=Req", "unit_is_Req.what_is_app_requests 5 1434000000"},
+		{"app.latency 1434000000 1e-3 unit=s path=/a.b", "path_is_/a_b.unit_is_s.what_is_app_latency 0.001 1434000000"},
+	}
+	for _, c := range cases {
+		got, err := parseOpentsdbPut(strings.Fields(c.put))
+		if err != nil {
+			t.Errorf("%s: %s", c.put, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s gives %s, want %s", c.put, got, c.want)
+		}
+	}
+}
+
+func TestParseOpentsdbPutInvalid(t *testing.T) {
+	defer func(orig map[string]string) { opentsdbUnits = orig }(opentsdbUnits)
+	opentsdbUnits = map[string]string{"sys.": "Pct"}
+	for _, put := range []string{
+		"sys.cpu.user 1434000000",
+		"sys.cpu.user now 1",
+		"sys.cpu.user 0 1",
+		"sys.cpu.user 1434000000 one",
+		"sys.cpu.user 1434000000 1 host",
+		"sys.cpu.user 1434000000 1 =web1",
+		// no unit
+		"app.requests 1434000000 5 host=web1",
+	} {
+		if _, err := parseOpentsdbPut(strings.Fields(put)); err == nil {
+			t.Errorf("'%s' should be rejected", put)
+		}
+	}
+}
+
+func TestM20Id(t *testing.T) {
+	id := m20Id(map[string]string{"what": "a.b", "unit": "B", "host": "web 1", "x=y": "a;b"})
+	if id != "host_is_web_1.unit_is_B.what_is_a_b.x_y_is_a_b" {
+		t.Fatalf("got id %s", id)
+	}
+	// the _is_ between key and value must be the first one in each node
+	id = m20Id(map[string]string{"a_is_b": "c_is_d", "e.is": "f.is.g", "h": "is_i"})
+	if id != "a-is-b_is_c-is-d.e-is_is_f-is-g.h_is_is_i" {
+		t.Fatalf("got id %s", id)
+	}
+}
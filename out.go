@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	m20 "github.com/metrics20/go-metrics20"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// forwarding of incoming lines to carbon daemons (carbon-relay, carbon-cache, ...)
+// every destination has its own bounded queue and a goroutine that owns the outbound connection.
+// when a destination can't keep up or is down, its queue fills up and new lines for it get dropped,
+// so that one bad destination never blocks ingestion or the other destinations.
+// optionally, a destination has a spool on disk which takes the lines that don't fit in the queue,
+// and all lines (including what's in the queue) while the destination is down. as soon as anything is
+// spooled, all new lines go through the spool as well, until it has been replayed, so that lines are
+// delivered in order.
+
+type destination struct {
+	spec     string // as configured
+	addr     string // host:port
+	instance string // optional carbon instance name, used for consistent hashing
+	queue    chan []byte
+	sent     stat
+	dropped  stat
+	queued   stat
+	spool    *spool // nil if spooling is disabled
+
+	sync.Mutex // protects down, and the order of queue vs spool when spooling
+	down       bool
+
+	shutdown chan struct{} // closed when we shut down
+	done     chan struct{} // closed by run once it has written out (or spooled) the queue
+}
+
+var destinations []*destination
+var ring *hashRing // nil unless we route by consistent hashing
+
+// statSafe turns a string into something that can be used as a tag value in a metric name
+func statSafe(s string) string {
+	return strings.NewReplacer(".", "_", ":", "_", " ", "_").Replace(s)
+}
+
+// parseDestinations splits a space and/or comma separated list of destinations
+// in host:port or host:port:instance format (like carbon's DESTINATIONS)
+func parseDestinations(list string) ([]string, error) {
+	specs := strings.FieldsFunc(list, func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+	for _, spec := range specs {
+		if _, _, err := splitDestination(spec); err != nil {
+			return nil, fmt.Errorf("invalid destination '%s': %s", spec, err.Error())
+		}
+	}
+	return specs, nil
+}
+
+// splitDestination splits host:port[:instance] into the address to connect to and the instance
+func splitDestination(spec string) (addr, instance string, err error) {
+	_, _, err = net.SplitHostPort(spec)
+	if err == nil {
+		return spec, "", nil
+	}
+	i := strings.LastIndex(spec, ":")
+	if i == -1 {
+		return "", "", err
+	}
+	if _, _, err2 := net.SplitHostPort(spec[:i]); err2 != nil {
+		return "", "", err
+	}
+	return spec[:i], spec[i+1:], nil
+}
+
+// host returns the host part of the destination's address
+func (d *destination) host() string {
+	host, _, _ := net.SplitHostPort(d.addr)
+	return host
+}
+
+func NewDestination(spec string, bufSize int) *destination {
+	key := statSafe(spec)
+	addr, instance, _ := splitDestination(spec)
+	d := &destination{
+		spec:     spec,
+		addr:     addr,
+		instance: instance,
+		queue:    make(chan []byte, bufSize),
+		sent:     NewCounter("unit_is_Metric.direction_is_out.type_is_sent.dest_is_"+key, false),
+		dropped:  NewCounter("unit_is_Metric.direction_is_out.type_is_dropped.dest_is_"+key, false),
+		shutdown: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	d.queued = NewFuncGauge("unit_is_Metric.direction_is_out.type_is_queued.dest_is_"+key, func() int64 {
+		return int64(len(d.queue))
+	})
+	return d
+}
+
+// close makes run write out the queue and return. lines that can't be written go to the spool, or are dropped.
+// there must be no more calls to enqueue.
+func (d *destination) close() {
+	close(d.shutdown)
+}
+
+// defaultDestinations returns all destinations, or those the ring maps the metric id to
+func defaultDestinations(id string) []*destination {
+	if ring != nil {
+		return ring.getDestinations(id)
+	}
+	return destinations
+}
+
+// forward hands a line to the destinations it's meant for, without ever blocking.
+// metric is only set for valid proto2 metrics.
+func forward(buf []byte, id string, proto int, metric *m20.MetricSpec) {
+	var dests []*destination
+	routes_lock.RLock()
+	rules := routes
+	routes_lock.RUnlock()
+	if rules == nil {
+		dests = defaultDestinations(id)
+	} else {
+		dests = route(rules, id, proto, metric)
+	}
+	for _, dest := range dests {
+		dest.enqueue(buf)
+	}
+}
+
+func (d *destination) enqueue(buf []byte) {
+	if d.spool == nil {
+		select {
+		case d.queue <- buf:
+		default:
+			d.dropped.Inc(1)
+		}
+		return
+	}
+	d.Lock()
+	if d.down || d.spool.Len() > 0 {
+		d.toSpool(buf)
+		d.Unlock()
+		return
+	}
+	select {
+	case d.queue <- buf:
+	default:
+		d.toSpool(buf)
+	}
+	d.Unlock()
+}
+
+func (d *destination) toSpool(buf []byte) {
+	if !d.spool.Write(buf) {
+		d.dropped.Inc(1)
+	}
+}
+
+// setDown marks the destination as (un)reachable. when it goes down and we have a spool,
+// everything that's still in the queue is moved into the spool, unless the spool already has lines:
+// those came in after the queued ones (enqueue doesn't queue while there's a spool), and the spool can
+// only be appended to. while we're down, nothing new is queued, so the queue just waits for us to reconnect.
+func (d *destination) setDown(down bool) {
+	if d.spool == nil {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+	if down && !d.down && d.spool.Len() == 0 {
+		for len(d.queue) > 0 {
+			d.toSpool(<-d.queue)
+		}
+	}
+	d.down = down
+}
+
+// lines. we flush at least this often, so that we don't keep too many lines around in case the flush fails
+const maxUnflushed = 1000
+
+// run maintains the connection to the destination and writes out the queue, and the spool
+// whenever the queue is empty. lines are buffered and flushed whenever the queue runs empty.
+// lines that were written but not flushed when the connection breaks are written again once we're reconnected,
+// before anything else, as they're older than whatever is queued or spooled.
+func (d *destination) run(reconnectMin, reconnectMax, timeout time.Duration) {
+	var conn net.Conn
+	var w *bufio.Writer
+	var unflushed [][]byte // lines written into w since the last successful flush
+	backoff := reconnectMin
+
+	write := func(buf []byte) error {
+		unflushed = append(unflushed, buf)
+		_, err := w.Write(buf)
+		return err
+	}
+
+	// flush returns false if the connection broke. the unflushed lines are then kept for the next connection
+	flush := func() bool {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+		err := w.Flush()
+		if err != nil {
+			fmt.Printf("WARN write to %s failed: %s. reconnecting, and writing %d lines again\n", d.addr, err.Error(), len(unflushed))
+			conn.Close()
+			conn = nil
+			return false
+		}
+		d.sent.Inc(int64(len(unflushed)))
+		unflushed = unflushed[:0]
+		return true
+	}
+
+	finish := func() {
+		defer close(d.done)
+		if conn != nil {
+			for len(d.queue) > 0 {
+				write(<-d.queue)
+			}
+			if flush() {
+				conn.Close()
+			}
+		}
+		// if we're not connected, whatever we couldn't write goes into the spool, or is dropped without one.
+		// in the spool, it ends up after what's already there, though it's older.
+		for len(d.queue) > 0 {
+			unflushed = append(unflushed, <-d.queue)
+		}
+		if d.spool == nil && len(unflushed) > 0 {
+			fmt.Printf("WARN %s is down. dropping %d lines\n", d.addr, len(unflushed))
+			d.dropped.Inc(int64(len(unflushed)))
+		}
+		if d.spool != nil {
+			for _, buf := range unflushed {
+				d.toSpool(buf)
+			}
+			d.spool.Close()
+		}
+	}
+
+	for {
+		select {
+		case <-d.shutdown:
+			finish()
+			return
+		default:
+		}
+		if conn == nil {
+			var err error
+			conn, err = net.DialTimeout("tcp", d.addr, timeout)
+			if err != nil {
+				fmt.Printf("WARN can't connect to %s: %s. retrying in %s\n", d.addr, err.Error(), backoff)
+				conn = nil
+				d.setDown(true)
+				d.wait(backoff)
+				backoff *= 2
+				if backoff > reconnectMax {
+					backoff = reconnectMax
+				}
+				continue
+			}
+			fmt.Printf("connected to %s\n", d.addr)
+			backoff = reconnectMin
+			w = bufio.NewWriter(conn)
+			if len(unflushed) > 0 {
+				for _, buf := range unflushed {
+					w.Write(buf)
+				}
+				if !flush() {
+					continue
+				}
+			}
+			d.setDown(false)
+		}
+		if d.spool != nil && d.spool.Len() > 0 {
+			select {
+			case buf := <-d.queue:
+				err := write(buf)
+				if err != nil || len(d.queue) == 0 || len(unflushed) >= maxUnflushed {
+					flush()
+				}
+			case <-d.shutdown:
+			default:
+				for _, buf := range d.spool.Read(maxUnflushed) {
+					write(buf)
+				}
+				flush()
+			}
+			continue
+		}
+		select {
+		case buf := <-d.queue:
+			err := write(buf)
+			if err != nil || len(d.queue) == 0 || len(unflushed) >= maxUnflushed {
+				flush()
+			}
+		case <-d.shutdown:
+		}
+	}
+}
+
+// wait sleeps for the given duration, or until we shut down.
+// meanwhile the queue fills up (unless we spool), and once it's full, enqueue drops new lines.
+func (d *destination) wait(dur time.Duration) {
+	timer := time.NewTimer(dur)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-d.shutdown:
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDestinations(t *testing.T) {
+	addrs, err := parseDestinations("10.0.0.1:2003 10.0.0.2:2003,localhost:2103")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 3 || addrs[0] != "10.0.0.1:2003" || addrs[1] != "10.0.0.2:2003" || addrs[2] != "localhost:2103" {
+		t.Fatalf("got destinations %v", addrs)
+	}
+	addrs, err = parseDestinations("10.0.0.1:2004:a 10.0.0.2:2004:b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr, instance, _ := splitDestination(addrs[1]); addr != "10.0.0.2:2004" || instance != "b" {
+		t.Fatalf("%s splits into %s and %s", addrs[1], addr, instance)
+	}
+	addrs, err = parseDestinations("")
+	if err != nil || len(addrs) != 0 {
+		t.Fatalf("empty list gives %v, %v", addrs, err)
+	}
+	for _, list := range []string{"localhost", "10.0.0.1:2003 10.0.0.2"} {
+		if _, err := parseDestinations(list); err == nil {
+			t.Errorf("'%s' should be rejected", list)
+		}
+	}
+}
+
+// readLines reads lines from the first connection to l, and checks they are what we want
+func readLines(t *testing.T, l net.Listener, want []string) {
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	for i, line := range want {
+		got, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("line %d: %s", i, err)
+		}
+		if got != line {
+			t.Fatalf("line %d is %q, want %q", i, got, line)
+		}
+	}
+}
+
+func TestForward(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dest := NewDestination(l.Addr().String(), 100)
+	go dest.run(10*time.Millisecond, 100*time.Millisecond, time.Second)
+	defer func(orig []*destination) { destinations = orig }(destinations)
+	destinations = []*destination{dest}
+
+	lines := []string{"a.b.c 1 1434000000\n", "a.b.d 2 1434000000\n", "unit_is_B.what_is_mem 3 1434000000\n"}
+	for _, line := range lines {
+		forward([]byte(line), strings.SplitN(line, " ", 2)[0], 1, nil)
+	}
+	readLines(t, l, lines)
+}
+
+// when a destination can't keep up, its queue fills up and new lines are dropped, without blocking
+func TestForwardQueueFull(t *testing.T) {
+	dest := NewDestination("127.0.0.1:9", 2)
+	for i := 0; i < 5; i++ {
+		dest.enqueue([]byte("a.b.c 1 1434000000\n"))
+	}
+	if len(dest.queue) != 2 {
+		t.Fatalf("queue has %d lines, want 2", len(dest.queue))
+	}
+	if n := dest.dropped.Count(); n != 3 {
+		t.Fatalf("%d lines dropped, want 3", n)
+	}
+	// the gauge reads the queue itself, it doesn't need run to answer
+	if n := dest.queued.Count(); n != 2 {
+		t.Fatalf("queued gauge is %d, want 2", n)
+	}
+}
+
+func isDown(d *destination) bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.down
+}
+
+// lines for a destination that is down are spooled, and delivered in order once it comes up
+func TestForwardSpoolWhileDown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// an address nobody listens on, for now
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	dest := NewDestination(addr, 5)
+	dest.spool, err = NewSpool(dir, 1<<20, 1<<20, "test_forward_down")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go dest.run(10*time.Millisecond, 50*time.Millisecond, time.Second)
+	for !isDown(dest) {
+		time.Sleep(time.Millisecond)
+	}
+	var lines []string
+	for i := 0; i < 50; i++ {
+		line := fmt.Sprintf("some.metric.%d %d 1434000000\n", i, i)
+		lines = append(lines, line)
+		dest.enqueue([]byte(line))
+	}
+	if n := dest.dropped.Count(); n != 0 {
+		t.Fatalf("%d lines dropped, want 0", n)
+	}
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	readLines(t, l, lines)
+}
+
+// on shutdown, a destination writes out its queue before it's done
+func TestDestinationClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dest := NewDestination(l.Addr().String(), 100)
+	var lines []string
+	for i := 0; i < 20; i++ {
+		line := fmt.Sprintf("some.metric.%d %d 1434000000\n", i, i)
+		lines = append(lines, line)
+		dest.enqueue([]byte(line))
+	}
+	go dest.run(10*time.Millisecond, 100*time.Millisecond, time.Second)
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	dest.close()
+	select {
+	case <-dest.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the destination to finish")
+	}
+	got, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != strings.Join(lines, "") {
+		t.Fatalf("got %q, want %q", got, lines)
+	}
+}
+
+// on shutdown, a destination that is down spools its queue, for the next run
+func TestDestinationCloseSpools(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	dest := NewDestination(addr, 100)
+	dest.spool, err = NewSpool(dir, 1<<20, 1<<20, "test_close_down")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for i := 0; i < 20; i++ {
+		line := fmt.Sprintf("some.metric.%d %d 1434000000\n", i, i)
+		lines = append(lines, line)
+		dest.enqueue([]byte(line))
+	}
+	dest.close()
+	go dest.run(10*time.Millisecond, 100*time.Millisecond, time.Second)
+	select {
+	case <-dest.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the destination to finish")
+	}
+	if n := dest.dropped.Count(); n != 0 {
+		t.Fatalf("%d lines dropped, want 0", n)
+	}
+	s, err := NewSpool(dir, 1<<20, 1<<20, "test_close_down_reopened")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, line := range s.Read(100) {
+		got = append(got, string(line))
+	}
+	if strings.Join(got, "") != strings.Join(lines, "") {
+		t.Fatalf("spooled %q, want %q", got, lines)
+	}
+}
+
+// lines that overflowed the queue into the spool come after the queued ones, also when the destination then
+// turns out to be down
+func TestForwardSpoolOverflowOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	dest := NewDestination(addr, 5)
+	dest.spool, err = NewSpool(dir, 1<<20, 1<<20, "test_overflow_order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for i := 0; i < 50; i++ {
+		line := fmt.Sprintf("some.metric.%d %d 1434000000\n", i, i)
+		lines = append(lines, line)
+		dest.enqueue([]byte(line))
+	}
+	go dest.run(10*time.Millisecond, 50*time.Millisecond, time.Second)
+	for !isDown(dest) {
+		time.Sleep(time.Millisecond)
+	}
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	readLines(t, l, lines)
+}
+
+// completeLines returns the newline terminated lines in data
+func completeLines(data []byte) []string {
+	lines := strings.SplitAfter(string(data), "\n")
+	if !strings.HasSuffix(lines[len(lines)-1], "\n") {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// when a flush fails, the lines in it are written again on the next connection, rather than lost
+func TestDestinationFlushFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	dest := NewDestination(l.Addr().String(), 10)
+	dest.spool, err = NewSpool(dir, 1<<20, 1<<30, "test_flush_failed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// far more than the socket buffers hold, so writing into a connection nobody reads from times out
+	padding := strings.Repeat("x", 1000)
+	var lines []string
+	for i := 0; i < 20000; i++ {
+		line := fmt.Sprintf("some.metric.%d.%s %d 1434000000\n", i, padding, i)
+		lines = append(lines, line)
+		dest.enqueue([]byte(line))
+	}
+	go dest.run(10*time.Millisecond, 50*time.Millisecond, 100*time.Millisecond)
+
+	first, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(second)
+	var got []string
+	for len(got) == 0 || got[len(got)-1] != lines[len(lines)-1] {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("after %d lines on the second connection: %s", len(got), err)
+		}
+		got = append(got, line)
+	}
+	first.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, _ := ioutil.ReadAll(first)
+	gotFirst := completeLines(data)
+
+	// the second connection picks up where the last successful flush on the first one ended, or before that
+	start := len(lines) - len(got)
+	if start > len(gotFirst) || strings.Join(got, "") != strings.Join(lines[start:], "") {
+		t.Fatalf("the first connection got %d lines, the second the last %d of %d", len(gotFirst), len(got), len(lines))
+	}
+	if strings.Join(gotFirst, "") != strings.Join(lines[:len(gotFirst)], "") {
+		t.Fatalf("the first connection got other lines than the first %d", len(gotFirst))
+	}
+	if n := dest.dropped.Count(); n != 0 {
+		t.Fatalf("%d lines dropped, want 0", n)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	m20 "github.com/metrics20/go-metrics20"
+)
+
+// the parsing stage: listeners collect lines into batches and put them on lines_read.
+// in.parsers workers take batches from there, forward every line and classify it.
+// the metrics are handed to the trackers in batches as well, one per input batch.
+// lines are only ever handled as byte slices into the batch's buffer; the only string we create
+// for a line is its id, which we need to forward and track it anyway.
+// note that with more than one parser, lines from different batches may be forwarded out of order.
+
+var (
+	backlog_proto1 int64 // metrics waiting for the proto1 trackers, which take batches
+	backlog_proto2 int64 // metrics waiting for the proto2 trackers, which take batches
+)
+
+// lineBatcher collects lines in a shared buffer, so that a batch needs only a few allocations.
+// in lenient mode, it canonicalizes lines while copying them: any run of whitespace separates fields,
+// and every line ends up as fields separated by a single space, terminated by a single newline.
+type lineBatcher struct {
+	size    int
+	lenient bool
+	data    []byte
+	lines   [][]byte
+}
+
+func newLineBatcher(size int, lenient bool) *lineBatcher {
+	return &lineBatcher{
+		size:    size,
+		lenient: lenient,
+		data:    make([]byte, 0, size*64),
+		lines:   make([][]byte, 0, size),
+	}
+}
+
+func isWhitespace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\v' || c == '\f'
+}
+
+// add copies the line into the batch, and submits the batch when full
+func (b *lineBatcher) add(line []byte) {
+	// a canonicalized line is at most one byte longer
+	if len(b.data)+len(line)+1 > cap(b.data) {
+		// the lines we handed out keep referencing the old buffer
+		size := b.size * 64
+		if len(line)+1 > size {
+			size = len(line) + 1
+		}
+		b.data = make([]byte, 0, size)
+	}
+	start := len(b.data)
+	if b.lenient {
+		for i := 0; i < len(line); {
+			for i < len(line) && isWhitespace(line[i]) {
+				i++
+			}
+			j := i
+			for j < len(line) && !isWhitespace(line[j]) {
+				j++
+			}
+			if j > i {
+				if len(b.data) > start {
+					b.data = append(b.data, ' ')
+				}
+				b.data = append(b.data, line[i:j]...)
+			}
+			i = j
+		}
+		if len(b.data) == start {
+			// nothing but whitespace
+			return
+		}
+		b.data = append(b.data, '\n')
+	} else {
+		b.data = append(b.data, line...)
+	}
+	b.lines = append(b.lines, b.data[start:len(b.data):len(b.data)])
+	if len(b.lines) == b.size {
+		b.flush()
+	}
+}
+
+// flush submits the lines collected so far
+func (b *lineBatcher) flush() {
+	if len(b.lines) == 0 {
+		return
+	}
+	lines_read <- b.lines
+	b.lines = make([][]byte, 0, b.size)
+	// the remainder of the buffer is not referenced by any line, so we can keep filling it
+	b.data = b.data[len(b.data):]
+}
+
+// submitLines submits lines that are already allocated, in batches
+func submitLines(lines [][]byte) {
+	for len(lines) > 0 {
+		n := len(lines)
+		if n > *in_batch_size {
+			n = *in_batch_size
+		}
+		lines_read <- lines[:n:n]
+		lines = lines[n:]
+	}
+}
+
+// readLine reads a line, including the newline. the returned slice is only valid until the next read.
+// lines longer than maxLen are discarded up to and including their newline, in which case tooLong is set.
+// if the connection ends without a final newline, the partial line is returned along with the error.
+func readLine(reader *bufio.Reader, maxLen int) (line []byte, tooLong bool, err error) {
+	line, err = reader.ReadSlice('\n')
+	if err != bufio.ErrBufferFull && len(line) <= maxLen {
+		return line, false, err
+	}
+	if len(line) > maxLen {
+		tooLong = true
+		line = nil
+	} else {
+		// longer than the reader's buffer, but allowed. rare enough to not care about allocations
+		line = append([]byte(nil), line...)
+	}
+	for err == bufio.ErrBufferFull {
+		var more []byte
+		more, err = reader.ReadSlice('\n')
+		if !tooLong && len(line)+len(more) > maxLen {
+			tooLong = true
+			line = nil
+		}
+		if !tooLong {
+			line = append(line, more...)
+		}
+	}
+	return line, tooLong, err
+}
+
+// splitLine splits a line (without surrounding whitespace) into id, value and timestamp without allocating.
+// like splitting on every single space, consecutive spaces make for empty fields.
+// n is the number of fields found, but we stop counting after 4.
+func splitLine(line []byte) (fields [3][]byte, n int) {
+	for n < 4 {
+		i := bytes.IndexByte(line, ' ')
+		if n < 3 {
+			if i == -1 {
+				fields[n] = line
+			} else {
+				fields[n] = line[:i]
+			}
+		}
+		n++
+		if i == -1 {
+			break
+		}
+		line = line[i+1:]
+	}
+	return fields, n
+}
+
+func processInputLines() {
+	defer parsers.Done()
+	var proto1 []string
+	var proto2 []m20.MetricSpec
+	for batch := range lines_read {
+		for _, buf := range batch {
+			proto1, proto2 = processLine(buf, proto1, proto2)
+		}
+		if len(proto1) > 0 {
+			submitProto1(proto1)
+			proto1 = nil
+		}
+		if len(proto2) > 0 {
+			submitProto2(proto2)
+			proto2 = nil
+		}
+	}
+}
+
+// processLine forwards a valid line, and, if its metric id is valid too, adds the metric to proto1 or proto2
+func processLine(buf []byte, proto1 []string, proto2 []m20.MetricSpec) ([]string, []m20.MetricSpec) {
+	fields, n := splitLine(bytes.TrimSpace(buf))
+	if n != 3 {
+		if isVerbose() {
+			fmt.Println("line has !=3 elements:", string(bytes.TrimSpace(buf)))
+		}
+		in_lines_bad_total.Inc(1)
+		return proto1, proto2
+	}
+	buf, ok := validateLine(buf, fields)
+	if !ok {
+		return proto1, proto2
+	}
+	id := string(fields[0])
+	if isTaggedSeries(id) {
+		metric, err := parseTaggedSeries(id, *in_tagged_unit)
+		if err != nil {
+			if isVerbose() {
+				fmt.Println(err)
+			}
+			in_metrics_tagged_bad_total.Inc(1)
+			forward(buf, id, 2, nil)
+		} else {
+			in_metrics_tagged_good_total.Inc(1)
+			forward(buf, id, 2, metric)
+			proto2 = append(proto2, *metric)
+		}
+	} else if m20.IsMetric20(id) {
+		metric, err := m20.NewMetricSpec(id)
+		if err != nil {
+			if isVerbose() {
+				fmt.Println(err)
+			}
+			in_metrics_proto2_bad_total.Inc(1)
+			forward(buf, id, 2, nil)
+		} else {
+			in_metrics_proto2_good_total.Inc(1)
+			forward(buf, id, 2, metric)
+			proto2 = append(proto2, *metric)
+		}
+	} else {
+		forward(buf, id, 1, nil)
+		err := m20.InitialValidation(id, m20.Legacy)
+		if err != nil {
+			if isVerbose() {
+				fmt.Println(err)
+			}
+			in_metrics_proto1_bad_total.Inc(1)
+		} else {
+			in_metrics_proto1_good_total.Inc(1)
+			proto1 = append(proto1, id)
+		}
+	}
+	return proto1, proto2
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	m20 "github.com/metrics20/go-metrics20"
+	"strings"
+	"testing"
+)
+
+func TestSplitLine(t *testing.T) {
+	cases := []struct {
+		in     string
+		fields []string
+		n      int
+	}{
+		{"a.b 1 2", []string{"a.b", "1", "2"}, 3},
+		{"a.b 1", []string{"a.b", "1", ""}, 2},
+		{"a.b", []string{"a.b", "", ""}, 1},
+		{"", []string{"", "", ""}, 1},
+		{"a.b 1 2 3", []string{"a.b", "1", "2"}, 4},
+		{"a.b 1 2 3 4 5", []string{"a.b", "1", "2"}, 4},
+		{"a.b  1 2", []string{"a.b", "", "1"}, 4},
+	}
+	for _, c := range cases {
+		fields, n := splitLine([]byte(c.in))
+		got := []string{string(fields[0]), string(fields[1]), string(fields[2])}
+		if n != c.n || strings.Join(got, "|") != strings.Join(c.fields, "|") {
+			t.Errorf("splitLine(%q) = %q, %d, want %q, %d", c.in, got, n, c.fields, c.n)
+		}
+	}
+}
+
+func TestLineBatcher(t *testing.T) {
+	defer func(orig chan [][]byte) { lines_read = orig }(lines_read)
+	lines_read = make(chan [][]byte, 10)
+
+	b := newLineBatcher(3, false)
+	buf := []byte("a.b 1 1434000000\n")
+	for i := 0; i < 4; i++ {
+		// the batcher must copy, the caller reuses its buffer
+		buf[2] = byte('0' + i)
+		b.add(buf)
+	}
+	if len(lines_read) != 1 {
+		t.Fatalf("%d batches submitted, want 1", len(lines_read))
+	}
+	b.flush()
+	b.flush()
+	if len(lines_read) != 2 {
+		t.Fatalf("%d batches submitted, want 2", len(lines_read))
+	}
+	var got []string
+	for i := 0; i < 2; i++ {
+		for _, line := range <-lines_read {
+			got = append(got, string(line))
+		}
+	}
+	want := []string{"a.0 1 1434000000\n", "a.1 1 1434000000\n", "a.2 1 1434000000\n", "a.3 1 1434000000\n"}
+	if strings.Join(got, "") != strings.Join(want, "") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// a line longer than the buffer
+	long := append(bytes.Repeat([]byte("x"), 1000), '\n')
+	b.add(long)
+	b.flush()
+	if line := (<-lines_read)[0]; !bytes.Equal(line, long) {
+		t.Errorf("got %q, want the long line", line)
+	}
+}
+
+func TestLineBatcherLenient(t *testing.T) {
+	defer func(orig chan [][]byte) { lines_read = orig }(lines_read)
+	lines_read = make(chan [][]byte, 10)
+
+	b := newLineBatcher(10, true)
+	for _, line := range []string{
+		"a.b 1 1434000000\n",
+		"  a.b\t2  1434000000 \r\n",
+		" \t\r\n",
+		"a.b   3\t\t1434000000",
+		"a.b 4\n",
+	} {
+		b.add([]byte(line))
+	}
+	b.flush()
+	var got []string
+	for _, line := range <-lines_read {
+		got = append(got, string(line))
+	}
+	want := []string{"a.b 1 1434000000\n", "a.b 2 1434000000\n", "a.b 3 1434000000\n", "a.b 4\n"}
+	if strings.Join(got, "") != strings.Join(want, "") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	long := strings.Repeat("x", 40)
+	input := "a.b 1 1434000000\n" + long + "\n" + long[:30] + "\n" + long + long + "\nc.d 2 1434000000"
+	// a buffer smaller than some lines
+	reader := bufio.NewReaderSize(strings.NewReader(input), 16)
+	want := []struct {
+		line    string
+		tooLong bool
+	}{
+		{"a.b 1 1434000000\n", false},
+		{"", true},
+		{long[:30] + "\n", false},
+		{"", true},
+		{"c.d 2 1434000000", false},
+	}
+	for i, w := range want {
+		line, tooLong, err := readLine(reader, 32)
+		if string(line) != w.line || tooLong != w.tooLong {
+			t.Errorf("line %d: got %q, %v, want %q, %v", i, line, tooLong, w.line, w.tooLong)
+		}
+		if (i == len(want)-1) != (err != nil) {
+			t.Errorf("line %d: got error %v", i, err)
+		}
+	}
+}
+
+// benchLines returns n lines: mostly proto1, some proto2 and some tagged series, like real traffic
+func benchLines(n int) [][]byte {
+	lines := make([][]byte, n)
+	for i := range lines {
+		switch i % 10 {
+		case 0:
+			lines[i] = []byte(fmt.Sprintf("unit_is_B.what_is_mem.server_is_web%d 1024 1434000000\n", i))
+		case 1:
+			lines[i] = []byte(fmt.Sprintf("disk.read_bytes;host=db%d;unit=B 5 1434000000\n", i))
+		default:
+			lines[i] = []byte(fmt.Sprintf("servers.web%d.cpu.user 12.5 1434000000\n", i))
+		}
+	}
+	return lines
+}
+
+// oldProcessInputLines is processInputLines from before lines were batched, verbatim.
+// it takes the channels and verbose as arguments, so it doesn't depend on the globals.
+func oldProcessInputLines(lines_read chan []byte, proto1_read chan string, proto2_read chan m20.MetricSpec, verbose bool) {
+	for buf := range lines_read {
+		str := strings.TrimSpace(string(buf))
+		elements := strings.Split(str, " ")
+		if len(elements) != 3 {
+			if verbose {
+				fmt.Println("line has !=3 elements:", str)
+			}
+			in_lines_bad_total.Inc(1)
+			forward(buf, elements[0], 0, nil)
+			continue
+		}
+		id := elements[0]
+		if isTaggedSeries(id) {
+			metric, err := parseTaggedSeries(id, *in_tagged_unit)
+			if err != nil {
+				if verbose {
+					fmt.Println(err)
+				}
+				in_metrics_tagged_bad_total.Inc(1)
+				forward(buf, id, 2, nil)
+			} else {
+				in_metrics_tagged_good_total.Inc(1)
+				forward(buf, id, 2, metric)
+				proto2_read <- *metric
+			}
+		} else if m20.IsMetric20(id) {
+			metric, err := m20.NewMetricSpec(id)
+			if err != nil {
+				if verbose {
+					fmt.Println(err)
+				}
+				in_metrics_proto2_bad_total.Inc(1)
+				forward(buf, id, 2, nil)
+			} else {
+				in_metrics_proto2_good_total.Inc(1)
+				forward(buf, id, 2, metric)
+				proto2_read <- *metric
+			}
+		} else {
+			forward(buf, id, 1, nil)
+			err := m20.InitialValidation(id, m20.Legacy)
+			if err != nil {
+				if verbose {
+					fmt.Println(err)
+				}
+				in_metrics_proto1_bad_total.Inc(1)
+			} else {
+				in_metrics_proto1_good_total.Inc(1)
+				proto1_read <- elements[0]
+			}
+		}
+	}
+}
+
+func BenchmarkSplitStrings(b *testing.B) {
+	lines := benchLines(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		strings.Split(strings.TrimSpace(string(lines[i%len(lines)])), " ")
+	}
+}
+
+func BenchmarkSplitBytes(b *testing.B) {
+	lines := benchLines(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bytes.Split(bytes.TrimSpace(lines[i%len(lines)]), []byte(" "))
+	}
+}
+
+func BenchmarkSplitLine(b *testing.B) {
+	lines := benchLines(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		splitLine(bytes.TrimSpace(lines[i%len(lines)]))
+	}
+}
+
+// the old way, including the channel send per metric that batching replaced
+func BenchmarkProcessInputLinesOld(b *testing.B) {
+	lines := benchLines(1000)
+	in := make(chan []byte, 1000)
+	proto1 := make(chan string, 1000)
+	proto2 := make(chan m20.MetricSpec, 1000)
+	done := make(chan bool)
+	go func() {
+		oldProcessInputLines(in, proto1, proto2, false)
+		close(proto1)
+		close(proto2)
+	}()
+	go func() {
+		for range proto1 {
+		}
+		done <- true
+	}()
+	go func() {
+		for range proto2 {
+		}
+		done <- true
+	}()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		in <- lines[i%len(lines)]
+	}
+	close(in)
+	<-done
+	<-done
+}
+
+func BenchmarkProcessLine(b *testing.B) {
+	lines := benchLines(1000)
+	proto1 := make([]string, 0, len(lines))
+	proto2 := make([]m20.MetricSpec, 0, len(lines))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%len(lines) == 0 {
+			proto1, proto2 = proto1[:0], proto2[:0]
+		}
+		proto1, proto2 = processLine(lines[i%len(lines)], proto1, proto2)
+	}
+}
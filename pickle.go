@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// receiver for carbon's pickle protocol: every frame is a 4 byte big-endian length followed by
+// a pickled list of (path, (timestamp, value)) tuples.
+// we don't run a real unpickler (which can construct arbitrary objects), but only support the opcodes
+// needed to build lists, tuples, strings and numbers, which is all carbon and its clients emit.
+// anything else makes the frame invalid, and we drop the connection.
+
+const pickleMaxFrame = 1 << 20 // same limit as carbon's receiver
+
+type pickleList struct {
+	items []interface{}
+}
+
+type pickleTuple []interface{}
+
+func listenPickle(listener net.Listener) {
+	defer acceptors.Done()
+	for {
+		conn_in, err := listener.Accept()
+		if err != nil {
+			if isDraining() {
+				return
+			}
+			fmt.Fprint(os.Stderr, err)
+			continue
+		}
+		if !admitConn(conn_in) {
+			continue
+		}
+		go handlePickleClient(conn_in)
+	}
+}
+
+func handlePickleClient(conn_in net.Conn) {
+	defer releaseConn(conn_in)
+	reader := bufio.NewReader(idleReader{conn_in})
+	var header [4]byte
+	for {
+		_, err := io.ReadFull(reader, header[:])
+		if err != nil {
+			if isTimeout(err) {
+				in_conns_idle_total.Inc(1)
+			} else if err != io.EOF {
+				fmt.Printf("WARN pickle connection closed uncleanly/broken: %s\n", err.Error())
+				in_conns_broken_total.Inc(1)
+			}
+			return
+		}
+		size := binary.BigEndian.Uint32(header[:])
+		if size > pickleMaxFrame {
+			fmt.Printf("WARN pickle frame of %d bytes exceeds maximum of %d. closing connection\n", size, pickleMaxFrame)
+			in_pickle_bad_total.Inc(1)
+			return
+		}
+		frame := make([]byte, size)
+		_, err = io.ReadFull(reader, frame)
+		if err != nil {
+			fmt.Printf("WARN pickle connection broken during frame: %s\n", err.Error())
+			in_conns_broken_total.Inc(1)
+			return
+		}
+		obj, err := unpickle(frame)
+		var lines [][]byte
+		if err == nil {
+			lines, err = pickleToLines(obj)
+		}
+		if err != nil {
+			fmt.Printf("WARN invalid pickle frame: %s. closing connection\n", err.Error())
+			in_pickle_bad_total.Inc(1)
+			return
+		}
+		in_pickle_frames_total.Inc(1)
+		submitLines(lines)
+	}
+}
+
+// pickleToLines converts a list of (path, (timestamp, value)) into graphite lines.
+// metrics whose path can't be put in a line are skipped.
+func pickleToLines(obj interface{}) ([][]byte, error) {
+	list, ok := obj.(*pickleList)
+	if !ok {
+		return nil, fmt.Errorf("expected a list, got %T", obj)
+	}
+	lines := make([][]byte, 0, len(list.items))
+	for _, item := range list.items {
+		metric, ok := item.(pickleTuple)
+		if !ok || len(metric) != 2 {
+			return nil, errors.New("expected (path, (timestamp, value)) tuples")
+		}
+		path, ok := metric[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("expected path string, got %T", metric[0])
+		}
+		if !validPicklePath(path) {
+			// it would turn into a different line, or several
+			if isVerbose() {
+				fmt.Printf("dropping pickled metric with an empty path, or whitespace or control characters in it: %q\n", path)
+			}
+			in_pickle_bad_paths_total.Inc(1)
+			continue
+		}
+		point, ok := metric[1].(pickleTuple)
+		if !ok || len(point) != 2 {
+			return nil, fmt.Errorf("expected (timestamp, value) tuple for %s", path)
+		}
+		ts, err := pickleNumber(point[0])
+		if err != nil {
+			return nil, err
+		}
+		val, err := pickleNumber(point[1])
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, []byte(path+" "+val+" "+ts+"\n"))
+	}
+	return lines, nil
+}
+
+// validPicklePath tells whether a path can be put in a line as is: it must not be empty,
+// nor contain spaces or control characters
+func validPicklePath(path string) bool {
+	if path == "" {
+		return false
+	}
+	for i := 0; i < len(path); i++ {
+		if path[i] <= ' ' || path[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func pickleNumber(obj interface{}) (string, error) {
+	switch v := obj.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("expected a number, got %T", obj)
+}
+
+// unpickle decodes a pickle, supporting protocols 0 through 4, but only the opcodes for
+// lists, tuples, strings, ints and floats, and the memo.
+func unpickle(data []byte) (interface{}, error) {
+	var stack []interface{}
+	var marks []int
+	memo := make(map[int]interface{})
+	pos := 0
+
+	read := func(n int) ([]byte, error) {
+		if n < 0 || pos+n > len(data) {
+			return nil, errors.New("unexpected end of pickle")
+		}
+		b := data[pos : pos+n]
+		pos += n
+		return b, nil
+	}
+	readLine := func() (string, error) {
+		i := bytes.IndexByte(data[pos:], '\n')
+		if i == -1 {
+			return "", errors.New("unexpected end of pickle")
+		}
+		s := string(data[pos : pos+i])
+		pos += i + 1
+		return s, nil
+	}
+	readUint := func(n int) (int, error) {
+		b, err := read(n)
+		if err != nil {
+			return 0, err
+		}
+		v := uint64(0)
+		for i := n - 1; i >= 0; i-- {
+			v = v<<8 | uint64(b[i])
+		}
+		if v > math.MaxInt32 {
+			return 0, errors.New("length out of range")
+		}
+		return int(v), nil
+	}
+	pop := func() (interface{}, error) {
+		if len(stack) == 0 || (len(marks) > 0 && len(stack) == marks[len(marks)-1]) {
+			return nil, errors.New("stack underflow")
+		}
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v, nil
+	}
+	popMark := func() ([]interface{}, error) {
+		if len(marks) == 0 {
+			return nil, errors.New("no mark on the stack")
+		}
+		m := marks[len(marks)-1]
+		marks = marks[:len(marks)-1]
+		items := make([]interface{}, len(stack)-m)
+		copy(items, stack[m:])
+		stack = stack[:m]
+		return items, nil
+	}
+	top := func() (interface{}, error) {
+		if len(stack) == 0 {
+			return nil, errors.New("stack underflow")
+		}
+		return stack[len(stack)-1], nil
+	}
+
+	for {
+		b, err := read(1)
+		if err != nil {
+			return nil, err
+		}
+		op := b[0]
+		switch op {
+		case 0x80: // PROTO
+			_, err = read(1)
+		case 0x95: // FRAME
+			_, err = read(8)
+		case '.': // STOP
+			if len(stack) != 1 || len(marks) != 0 {
+				return nil, errors.New("malformed pickle: stack not empty at STOP")
+			}
+			return stack[0], nil
+		case '(': // MARK
+			marks = append(marks, len(stack))
+		case ']': // EMPTY_LIST
+			stack = append(stack, &pickleList{})
+		case 'l': // LIST
+			var items []interface{}
+			items, err = popMark()
+			stack = append(stack, &pickleList{items})
+		case 'a': // APPEND
+			var v, l interface{}
+			if v, err = pop(); err == nil {
+				if l, err = top(); err == nil {
+					list, ok := l.(*pickleList)
+					if !ok {
+						return nil, errors.New("APPEND to non-list")
+					}
+					list.items = append(list.items, v)
+				}
+			}
+		case 'e': // APPENDS
+			var items []interface{}
+			var l interface{}
+			if items, err = popMark(); err == nil {
+				if l, err = top(); err == nil {
+					list, ok := l.(*pickleList)
+					if !ok {
+						return nil, errors.New("APPENDS to non-list")
+					}
+					list.items = append(list.items, items...)
+				}
+			}
+		case ')': // EMPTY_TUPLE
+			stack = append(stack, pickleTuple{})
+		case 't': // TUPLE
+			var items []interface{}
+			items, err = popMark()
+			stack = append(stack, pickleTuple(items))
+		case 0x85, 0x86, 0x87: // TUPLE1, TUPLE2, TUPLE3
+			n := int(op-0x85) + 1
+			if len(stack) < n || (len(marks) > 0 && len(stack)-n < marks[len(marks)-1]) {
+				return nil, errors.New("stack underflow")
+			}
+			t := make(pickleTuple, n)
+			copy(t, stack[len(stack)-n:])
+			stack = append(stack[:len(stack)-n], t)
+		case 'S': // STRING
+			var s string
+			if s, err = readLine(); err == nil {
+				s, err = unquotePython(s)
+				stack = append(stack, s)
+			}
+		case 'V': // UNICODE
+			var s string
+			if s, err = readLine(); err == nil {
+				s, err = unescapeRawUnicode(s)
+				stack = append(stack, s)
+			}
+		case 'U', 'C', 0x8c: // SHORT_BINSTRING, SHORT_BINBYTES, SHORT_BINUNICODE
+			var n int
+			var s []byte
+			if n, err = readUint(1); err == nil {
+				if s, err = read(n); err == nil {
+					stack = append(stack, string(s))
+				}
+			}
+		case 'T', 'B', 'X': // BINSTRING, BINBYTES, BINUNICODE
+			var n int
+			var s []byte
+			if n, err = readUint(4); err == nil {
+				if s, err = read(n); err == nil {
+					stack = append(stack, string(s))
+				}
+			}
+		case 0x8d: // BINUNICODE8
+			var n int
+			var s []byte
+			if n, err = readUint(8); err == nil {
+				if s, err = read(n); err == nil {
+					stack = append(stack, string(s))
+				}
+			}
+		case 'I': // INT
+			var s string
+			var v int64
+			if s, err = readLine(); err == nil {
+				if v, err = strconv.ParseInt(s, 10, 64); err == nil {
+					stack = append(stack, v)
+				}
+			}
+		case 'L': // LONG
+			var s string
+			var v int64
+			if s, err = readLine(); err == nil {
+				if v, err = strconv.ParseInt(strings.TrimSuffix(s, "L"), 10, 64); err == nil {
+					stack = append(stack, v)
+				}
+			}
+		case 'J': // BININT
+			var b []byte
+			if b, err = read(4); err == nil {
+				stack = append(stack, int64(int32(binary.LittleEndian.Uint32(b))))
+			}
+		case 'K': // BININT1
+			var b []byte
+			if b, err = read(1); err == nil {
+				stack = append(stack, int64(b[0]))
+			}
+		case 'M': // BININT2
+			var b []byte
+			if b, err = read(2); err == nil {
+				stack = append(stack, int64(binary.LittleEndian.Uint16(b)))
+			}
+		case 0x8a: // LONG1
+			var n int
+			var b []byte
+			if n, err = readUint(1); err == nil {
+				if n > 8 {
+					return nil, errors.New("LONG1 out of range")
+				}
+				if b, err = read(n); err == nil {
+					v := int64(0)
+					for i := n - 1; i >= 0; i-- {
+						v = v<<8 | int64(b[i])
+					}
+					if n > 0 && n < 8 && b[n-1]&0x80 != 0 {
+						v -= 1 << uint(8*n)
+					}
+					stack = append(stack, v)
+				}
+			}
+		case 'F': // FLOAT
+			var s string
+			var v float64
+			if s, err = readLine(); err == nil {
+				if v, err = strconv.ParseFloat(s, 64); err == nil {
+					stack = append(stack, v)
+				}
+			}
+		case 'G': // BINFLOAT
+			var b []byte
+			if b, err = read(8); err == nil {
+				stack = append(stack, math.Float64frombits(binary.BigEndian.Uint64(b)))
+			}
+		case 0x94: // MEMOIZE
+			var v interface{}
+			if v, err = top(); err == nil {
+				memo[len(memo)] = v
+			}
+		case 'p': // PUT
+			var s string
+			var idx int
+			var v interface{}
+			if s, err = readLine(); err == nil {
+				if idx, err = strconv.Atoi(s); err == nil {
+					if v, err = top(); err == nil {
+						memo[idx] = v
+					}
+				}
+			}
+		case 'q', 'r': // BINPUT, LONG_BINPUT
+			n := 1
+			if op == 'r' {
+				n = 4
+			}
+			var idx int
+			var v interface{}
+			if idx, err = readUint(n); err == nil {
+				if v, err = top(); err == nil {
+					memo[idx] = v
+				}
+			}
+		case 'g', 'h', 'j': // GET, BINGET, LONG_BINGET
+			var idx int
+			if op == 'g' {
+				var s string
+				if s, err = readLine(); err == nil {
+					idx, err = strconv.Atoi(s)
+				}
+			} else if op == 'h' {
+				idx, err = readUint(1)
+			} else {
+				idx, err = readUint(4)
+			}
+			if err == nil {
+				v, ok := memo[idx]
+				if !ok {
+					return nil, fmt.Errorf("memo key %d not found", idx)
+				}
+				stack = append(stack, v)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported pickle opcode 0x%x at position %d", op, pos-1)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// unquotePython decodes a python 2 string repr, as used by the STRING opcode
+func unquotePython(s string) (string, error) {
+	if len(s) < 2 || (s[0] != '\'' && s[0] != '"') || s[len(s)-1] != s[0] {
+		return "", errors.New("invalid STRING argument")
+	}
+	body := s[1 : len(s)-1]
+	if s[0] == '\'' {
+		body = strings.Replace(body, `\'`, `'`, -1)
+		body = strings.Replace(body, `"`, `\"`, -1)
+	}
+	return strconv.Unquote(`"` + body + `"`)
+}
+
+// unescapeRawUnicode decodes python's raw-unicode-escape encoding, as used by the UNICODE opcode
+func unescapeRawUnicode(s string) (string, error) {
+	if !strings.Contains(s, `\u`) && !strings.Contains(s, `\U`) {
+		return s, nil
+	}
+	var out []rune
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && (s[i+1] == 'u' || s[i+1] == 'U') {
+			n := 4
+			if s[i+1] == 'U' {
+				n = 8
+			}
+			if i+2+n > len(s) {
+				return "", errors.New("truncated \\u escape")
+			}
+			r, err := strconv.ParseUint(s[i+2:i+2+n], 16, 32)
+			if err != nil {
+				return "", err
+			}
+			out = append(out, rune(r))
+			i += 1 + n
+			continue
+		}
+		out = append(out, rune(s[i]))
+	}
+	return string(out), nil
+}
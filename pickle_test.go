@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// all of these are pickle.dumps([("a.b.c", pt), ("d.e", (1700000001, -3)), ("f", pt), ("g", (1700000002, 12345678901))])
+// with pt = (1700000000, 1.5), so "f" gets pt from the memo
+var pickleCases = []struct {
+	name   string
+	pickle string
+}{
+	{"python 2, protocol 0", "(lp0\n(S'a.b.c'\np1\n(I1700000000\nF1.5\ntp2\ntp3\na(S'd.e'\np4\n(I1700000001\nI-3\ntp5\ntp6\na(S'f'\np7\ng2\ntp8\na(S'g'\np9\n(I1700000002\nL12345678901L\ntp10\ntp11\na."},
+	{"python 2, protocol 1", "]q\x00((U\x05a.b.cq\x01(J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00tq\x02tq\x03(U\x03d.eq\x04(J\x01\xf1SeJ\xfd\xff\xff\xfftq\x05tq\x06(U\x01fq\x07h\x02tq\x08(U\x01gq\x09(J\x02\xf1SeL12345678901L\ntq\ntq\x0be."},
+	{"python 2, protocol 2", "\x80\x02]q\x00(U\x05a.b.cq\x01J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03U\x03d.eq\x04J\x01\xf1SeJ\xfd\xff\xff\xff\x86q\x05\x86q\x06U\x01fq\x07h\x02\x86q\x08U\x01gq\x09J\x02\xf1Se\x8a\x055\x1c\xdc\xdf\x02\x86q\n\x86q\x0be."},
+	{"python 3, protocol 0", "(lp0\n(Va.b.c\np1\n(I1700000000\nF1.5\ntp2\ntp3\na(Vd.e\np4\n(I1700000001\nI-3\ntp5\ntp6\na(Vf\np7\ng2\ntp8\na(Vg\np9\n(I1700000002\nL12345678901L\ntp10\ntp11\na."},
+	{"python 3, protocol 1", "]q\x00((X\x05\x00\x00\x00a.b.cq\x01(J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00tq\x02tq\x03(X\x03\x00\x00\x00d.eq\x04(J\x01\xf1SeJ\xfd\xff\xff\xfftq\x05tq\x06(X\x01\x00\x00\x00fq\x07h\x02tq\x08(X\x01\x00\x00\x00gq\x09(J\x02\xf1SeL12345678901L\ntq\ntq\x0be."},
+	{"python 3, protocol 2", "\x80\x02]q\x00(X\x05\x00\x00\x00a.b.cq\x01J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x03\x00\x00\x00d.eq\x04J\x01\xf1SeJ\xfd\xff\xff\xff\x86q\x05\x86q\x06X\x01\x00\x00\x00fq\x07h\x02\x86q\x08X\x01\x00\x00\x00gq\x09J\x02\xf1Se\x8a\x055\x1c\xdc\xdf\x02\x86q\n\x86q\x0be."},
+}
+
+const pickleLines = "a.b.c 1.5 1700000000\nd.e -3 1700000001\nf 1.5 1700000000\ng 12345678901 1700000002\n"
+
+func unpickleLines(pickle string) (string, error) {
+	obj, err := unpickle([]byte(pickle))
+	if err != nil {
+		return "", err
+	}
+	lines, err := pickleToLines(obj)
+	if err != nil {
+		return "", err
+	}
+	var out []string
+	for _, line := range lines {
+		out = append(out, string(line))
+	}
+	return strings.Join(out, ""), nil
+}
+
+func TestUnpickle(t *testing.T) {
+	for _, c := range pickleCases {
+		lines, err := unpickleLines(c.pickle)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if lines != pickleLines {
+			t.Errorf("%s: got lines\n%s\nwant\n%s", c.name, lines, pickleLines)
+		}
+	}
+}
+
+func TestUnpickleInvalid(t *testing.T) {
+	cases := []struct {
+		name   string
+		pickle string
+	}{
+		{"empty", ""},
+		{"no stop", "(lp0\n"},
+		{"global", "cos\nsystem\n(S'true'\ntR."},
+		{"reduce", "\x80\x02]q\x00R."},
+		{"stack underflow", "\x80\x02\x86."},
+		{"unmatched mark", "(]."},
+		{"append to tuple", ")K\x01a."},
+		{"unknown memo key", "\x80\x02h\x05."},
+		{"truncated binunicode", "\x80\x02X\xff\x00\x00\x00abc."},
+		{"huge length", "\x80\x02X\xff\xff\xff\xffabc."},
+		{"two objects", "]]."},
+	}
+	for _, c := range cases {
+		_, err := unpickle([]byte(c.pickle))
+		if err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+}
+
+func TestPickleToLinesInvalid(t *testing.T) {
+	cases := []struct {
+		name   string
+		pickle string
+	}{
+		{"not a list", "\x80\x02)."},
+		{"not a tuple", "\x80\x02]q\x00K\x01a."},
+		{"path not a string", "\x80\x02]q\x00K\x01K\x01K\x02\x86\x86a."},
+		{"point not a tuple", "\x80\x02]q\x00U\x01aK\x01\x86a."},
+		{"value not a number", "\x80\x02]q\x00U\x01aK\x01U\x01x\x86\x86a."},
+	}
+	for _, c := range cases {
+		obj, err := unpickle([]byte(c.pickle))
+		if err != nil {
+			t.Errorf("%s: unpickle should work, but: %s", c.name, err)
+			continue
+		}
+		_, err = pickleToLines(obj)
+		if err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+}
+
+// paths that would turn into a different line are skipped, the rest of the frame is still used
+func TestPickleBadPaths(t *testing.T) {
+	bad := []string{"", "a b", "a\nb.c 1 2", "a\tb", "a\x00b", "a\x7fb"}
+	pickle := "\x80\x02]q\x00("
+	for _, path := range append(bad, "good") {
+		pickle += "U" + string(rune(len(path))) + path + "J\x00\xf1SeK\x01\x86\x86"
+	}
+	pickle += "e."
+	before := in_pickle_bad_paths_total.Count()
+	lines, err := unpickleLines(pickle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines != "good 1 1700000000\n" {
+		t.Fatalf("got lines %q", lines)
+	}
+	if skipped := in_pickle_bad_paths_total.Count() - before; skipped != int64(len(bad)) {
+		t.Fatalf("%d bad paths counted, want %d", skipped, len(bad))
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// receiver for prometheus' remote write protocol: an http POST with a snappy (block format) compressed
+// protobuf WriteRequest. like with pickle, we don't pull in the real libraries, but decode the few
+// messages we need ourselves:
+//
+//   message WriteRequest { repeated TimeSeries timeseries = 1; }
+//   message TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//   message Label        { string name = 1; string value = 2; }
+//   message Sample       { double value = 1; int64 timestamp = 2; } // timestamp in ms
+//
+// every series becomes a metric 2.0 with the series' labels as tags, __name__ as what, and a unit from the
+// unit label, the name's suffix (see promSuffixUnits), or prometheus.default_unit. series without unit are skipped.
+// the metric is expressed as a graphite line using the key_is_value notation, which is either processed
+// like any incoming line (so it gets indexed and forwarded, one line per sample), or only indexed.
+
+const promMaxBody = 32 << 20 // max size of a request, before and after decompression
+
+// unit suffixes, following prometheus' naming conventions. the first match wins.
+var promSuffixUnits = []struct {
+	suffix string
+	unit   string
+}{
+	{"_bytes", "B"},
+	{"_seconds", "s"},
+	{"_milliseconds", "ms"},
+	{"_microseconds", "us"},
+	{"_percent", "Pct"},
+	{"_celsius", "C"},
+	{"_volts", "V"},
+	{"_amperes", "A"},
+	{"_joules", "J"},
+	{"_hertz", "Hz"},
+}
+
+type promSample struct {
+	value float64
+	ts    int64
+}
+
+type promSeries struct {
+	labels  map[string]string
+	samples []promSample
+}
+
+// snappyDecode decompresses snappy's block format (not the framing format)
+func snappyDecode(src []byte) ([]byte, error) {
+	size, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, errors.New("snappy: invalid length")
+	}
+	if size > promMaxBody {
+		return nil, fmt.Errorf("snappy: decoded length %d exceeds maximum of %d", size, promMaxBody)
+	}
+	dst := make([]byte, 0, size)
+	src = src[n:]
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 3 {
+		case 0: // literal
+			length = int(tag >> 2)
+			src = src[1:]
+			if length >= 60 {
+				extra := length - 59 // length is stored in the next 1-4 bytes
+				if len(src) < extra {
+					return nil, errors.New("snappy: truncated literal")
+				}
+				length = 0
+				for i := 0; i < extra; i++ {
+					length |= int(src[i]) << (8 * uint(i))
+				}
+				src = src[extra:]
+			}
+			length++
+			if length <= 0 || length > len(src) || len(dst)+length > int(size) {
+				return nil, errors.New("snappy: invalid literal")
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case 1: // copy, 1 byte offset
+			if len(src) < 2 {
+				return nil, errors.New("snappy: truncated copy")
+			}
+			length = 4 + int(tag>>2)&7
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case 2: // copy, 2 byte offset
+			if len(src) < 3 {
+				return nil, errors.New("snappy: truncated copy")
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 3: // copy, 4 byte offset
+			if len(src) < 5 {
+				return nil, errors.New("snappy: truncated copy")
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) || len(dst)+length > int(size) {
+			return nil, errors.New("snappy: invalid copy")
+		}
+		// copies may overlap with what they produce, so go byte by byte
+		start := len(dst) - offset
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+	if len(dst) != int(size) {
+		return nil, errors.New("snappy: decoded length mismatch")
+	}
+	return dst, nil
+}
+
+// protoField returns the next field of a protobuf message: its number, wire type, and either its
+// varint/fixed value or, for length delimited fields, its bytes. it also returns the rest of the message.
+func protoField(buf []byte) (num int, wireType int, val uint64, data []byte, rest []byte, err error) {
+	key, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return 0, 0, 0, nil, nil, errors.New("protobuf: invalid field key")
+	}
+	buf = buf[n:]
+	num, wireType = int(key>>3), int(key&7)
+	switch wireType {
+	case 0:
+		val, n = binary.Uvarint(buf)
+		if n <= 0 {
+			return 0, 0, 0, nil, nil, errors.New("protobuf: invalid varint")
+		}
+		buf = buf[n:]
+	case 1:
+		if len(buf) < 8 {
+			return 0, 0, 0, nil, nil, errors.New("protobuf: truncated fixed64")
+		}
+		val = binary.LittleEndian.Uint64(buf)
+		buf = buf[8:]
+	case 2:
+		l, n := binary.Uvarint(buf)
+		if n <= 0 || l > uint64(len(buf)-n) {
+			return 0, 0, 0, nil, nil, errors.New("protobuf: invalid length")
+		}
+		data = buf[n : n+int(l)]
+		buf = buf[n+int(l):]
+	case 5:
+		if len(buf) < 4 {
+			return 0, 0, 0, nil, nil, errors.New("protobuf: truncated fixed32")
+		}
+		val = uint64(binary.LittleEndian.Uint32(buf))
+		buf = buf[4:]
+	default:
+		return 0, 0, 0, nil, nil, fmt.Errorf("protobuf: unsupported wire type %d", wireType)
+	}
+	return num, wireType, val, data, buf, nil
+}
+
+// parseWriteRequest decodes a (decompressed) WriteRequest. unknown fields, such as metadata, are ignored.
+func parseWriteRequest(buf []byte) ([]promSeries, error) {
+	var series []promSeries
+	for len(buf) > 0 {
+		num, wireType, _, data, rest, err := protoField(buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = rest
+		if num != 1 || wireType != 2 {
+			continue
+		}
+		s, err := parseTimeSeries(data)
+		if err != nil {
+			return nil, err
+		}
+		series = append(series, s)
+	}
+	return series, nil
+}
+
+func parseTimeSeries(buf []byte) (promSeries, error) {
+	s := promSeries{labels: make(map[string]string)}
+	for len(buf) > 0 {
+		num, wireType, _, data, rest, err := protoField(buf)
+		if err != nil {
+			return s, err
+		}
+		buf = rest
+		if wireType != 2 {
+			continue
+		}
+		switch num {
+		case 1:
+			var name, value string
+			for len(data) > 0 {
+				n, wt, _, d, r, err := protoField(data)
+				if err != nil {
+					return s, err
+				}
+				data = r
+				if wt == 2 && n == 1 {
+					name = string(d)
+				} else if wt == 2 && n == 2 {
+					value = string(d)
+				}
+			}
+			s.labels[name] = value
+		case 2:
+			var sample promSample
+			for len(data) > 0 {
+				n, wt, v, _, r, err := protoField(data)
+				if err != nil {
+					return s, err
+				}
+				data = r
+				if wt == 1 && n == 1 {
+					sample.value = math.Float64frombits(v)
+				} else if wt == 0 && n == 2 {
+					sample.ts = int64(v)
+				}
+			}
+			s.samples = append(s.samples, sample)
+		}
+	}
+	return s, nil
+}
+
+// promUnit returns the unit for a series name based on the naming conventions.
+// counters (_total) without further unit suffix count events.
+func promUnit(name string) string {
+	base := strings.TrimSuffix(name, "_total")
+	for _, su := range promSuffixUnits {
+		if strings.HasSuffix(base, su.suffix) {
+			return su.unit
+		}
+	}
+	if base != name {
+		return "Event"
+	}
+	return ""
+}
+
+// promTags converts the labels of a series into metrics 2.0 tags
+func promTags(labels map[string]string) (map[string]string, error) {
+	name := labels["__name__"]
+	if name == "" {
+		return nil, errors.New("series without __name__")
+	}
+	tags := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		// empty labels are the same as no label, and the other reserved labels are prometheus internals
+		if v == "" || strings.HasPrefix(k, "__") {
+			continue
+		}
+		tags[k] = v
+	}
+	unit := tags["unit"]
+	if unit == "" {
+		unit = promUnit(name)
+	}
+	if unit == "" {
+		unit = *prom_def_unit
+	}
+	if unit == "" {
+		return nil, fmt.Errorf("no unit known for series '%s'", name)
+	}
+	tags["what"] = name
+	tags["unit"] = unit
+	if strings.HasSuffix(name, "_total") {
+		tags["target_type"] = "counter"
+	}
+	return tags, nil
+}
+
+// handlePromSeries processes the series of a write request
+func handlePromSeries(series []promSeries) {
+	batch := newMetric20Batch(*prom_forward)
+	for _, s := range series {
+		tags, err := promTags(s.labels)
+		if err != nil {
+			if isVerbose() {
+				fmt.Printf("skipping prometheus series %v: %s\n", s.labels, err.Error())
+			}
+			in_prom_skipped_total.Inc(1)
+			continue
+		}
+		id := m20Id(tags)
+		in_prom_series_total.Inc(1)
+		for _, sample := range s.samples {
+			// NaN is also how prometheus marks stale series. graphite has no use for either.
+			if math.IsNaN(sample.value) || math.IsInf(sample.value, 0) {
+				continue
+			}
+			line := fmt.Sprintf("%s %s %d", id, strconv.FormatFloat(sample.value, 'f', -1, 64), sample.ts/1000)
+			batch.add(line)
+			if !*prom_forward {
+				// indexing needs the series only once
+				break
+			}
+		}
+	}
+	batch.flush()
+}
+
+// promWriteHandler implements the remote write endpoint
+func promWriteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, promMaxBody+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// prometheus doesn't retry on 4xx, which is what we want for requests we'll never be able to decode
+	if len(body) > promMaxBody {
+		in_prom_bad_total.Inc(1)
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	buf, err := snappyDecode(body)
+	if err != nil {
+		in_prom_bad_total.Inc(1)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	series, err := parseWriteRequest(buf)
+	if err != nil {
+		in_prom_bad_total.Inc(1)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	handlePromSeries(series)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listenPromHTTP(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/write", promWriteHandler)
+	err := serveHTTP(addr, mux)
+	if err != nil {
+		fmt.Println("Error opening prometheus remote write endpoint:", err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// protobuf encoding, just enough to build write requests
+
+func protoKey(num, wireType int) []byte {
+	return binary.AppendUvarint(nil, uint64(num<<3|wireType))
+}
+
+func protoBytes(num int, data []byte) []byte {
+	out := protoKey(num, 2)
+	out = binary.AppendUvarint(out, uint64(len(data)))
+	return append(out, data...)
+}
+
+func protoLabel(name, value string) []byte {
+	return protoBytes(1, append(protoBytes(1, []byte(name)), protoBytes(2, []byte(value))...))
+}
+
+func protoSample(value float64, ts int64) []byte {
+	sample := protoKey(1, 1)
+	sample = binary.LittleEndian.AppendUint64(sample, math.Float64bits(value))
+	sample = append(sample, protoKey(2, 0)...)
+	sample = binary.AppendUvarint(sample, uint64(ts))
+	return protoBytes(2, sample)
+}
+
+func TestSnappyDecode(t *testing.T) {
+	cases := []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{"literal", []byte{5, 4 << 2, 'h', 'e', 'l', 'l', 'o'}, "hello"},
+		// "abc", then a copy of 6 bytes from offset 3
+		{"copy", []byte{9, 2 << 2, 'a', 'b', 'c', 2<<2 | 1, 3}, "abcabcabc"},
+		{"empty", []byte{0}, ""},
+	}
+	for _, c := range cases {
+		got, err := snappyDecode(c.in)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if string(got) != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+	invalid := [][]byte{
+		{},
+		// claims 10 bytes, has 5
+		{10, 4 << 2, 'h', 'e', 'l', 'l', 'o'},
+		// copy from before the start
+		{6, 0, 'a', 1<<2 | 1, 5},
+	}
+	for _, in := range invalid {
+		if _, err := snappyDecode(in); err == nil {
+			t.Errorf("%v should be rejected", in)
+		}
+	}
+}
+
+func TestParseWriteRequest(t *testing.T) {
+	var series []byte
+	series = append(series, protoLabel("__name__", "http_requests_total")...)
+	series = append(series, protoLabel("job", "api")...)
+	series = append(series, protoSample(5, 1434000000000)...)
+	series = append(series, protoSample(7.5, 1434000015000)...)
+	req := protoBytes(1, series)
+	// metadata, which we ignore
+	req = append(req, protoBytes(3, []byte("whatever"))...)
+	req = append(req, protoBytes(1, protoLabel("__name__", "up"))...)
+
+	got, err := parseWriteRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d series, want 2", len(got))
+	}
+	s := got[0]
+	if len(s.labels) != 2 || s.labels["__name__"] != "http_requests_total" || s.labels["job"] != "api" {
+		t.Errorf("got labels %v", s.labels)
+	}
+	if len(s.samples) != 2 || s.samples[0] != (promSample{5, 1434000000000}) || s.samples[1] != (promSample{7.5, 1434000015000}) {
+		t.Errorf("got samples %v", s.samples)
+	}
+	if got[1].labels["__name__"] != "up" || len(got[1].samples) != 0 {
+		t.Errorf("got second series %v", got[1])
+	}
+	if _, err := parseWriteRequest(req[:len(req)-2]); err == nil {
+		t.Error("a truncated request should be rejected")
+	}
+}
+
+func TestPromTags(t *testing.T) {
+	cases := []struct {
+		labels map[string]string
+		want   map[string]string
+	}{
+		{
+			map[string]string{"__name__": "http_requests_total", "job": "api", "empty": ""},
+			map[string]string{"what": "http_requests_total", "unit": "Event", "target_type": "counter", "job": "api"},
+		},
+		{
+			map[string]string{"__name__": "node_memory_free_bytes", "__meta": "x"},
+			map[string]string{"what": "node_memory_free_bytes", "unit": "B"},
+		},
+		{
+			map[string]string{"__name__": "request_duration_seconds_total"},
+			map[string]string{"what": "request_duration_seconds_total", "unit": "s", "target_type": "counter"},
+		},
+		{
+			map[string]string{"__name__": "temperature", "unit": "F"},
+			map[string]string{"what": "temperature", "unit": "F"},
+		},
+	}
+	for _, c := range cases {
+		tags, err := promTags(c.labels)
+		if err != nil {
+			t.Errorf("%v: %s", c.labels, err)
+			continue
+		}
+		if len(tags) != len(c.want) {
+			t.Errorf("%v gives tags %v, want %v", c.labels, tags, c.want)
+			continue
+		}
+		for k, v := range c.want {
+			if tags[k] != v {
+				t.Errorf("%v gives tags %v, want %v", c.labels, tags, c.want)
+				break
+			}
+		}
+	}
+	for _, labels := range []map[string]string{{"job": "api"}, {"__name__": "temperature"}} {
+		if _, err := promTags(labels); err == nil {
+			t.Errorf("%v should be rejected", labels)
+		}
+	}
+}
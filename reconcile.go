@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	m20 "github.com/metrics20/go-metrics20"
+	elastigo "github.com/vimeo/carbon-tagger/_third_party/github.com/mattbaird/elastigo/lib"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// reconciliation: carbon-tagger [-config file] reconcile [-from addr] [-dry-run]
+// compares the ids carbon-tagger has seen with the ones in the index, and resubmits the ones that are missing,
+// through bulk indexers like the trackers use. the seen ids come from a running carbon-tagger (-from, its
+// stats.http_addr, which serves them on /admin/seen), or from the seen caches persisted in elasticsearch.cache_dir.
+// either way, that needs elasticsearch.seen_set = "map", as the other sets don't keep the ids.
+// we print how many ids are present in the index, missing from it, extra (in the index, but not seen)
+// and how many we resent.
+
+// how long seenHandler waits for a tracker to take its request. they're busy while ES is slow
+var seenDumpTimeout = 10 * time.Second
+
+// seenHandler serves the ids in the trackers' seen caches for a protocol (?proto=1 or 2), one per line
+func seenHandler(w http.ResponseWriter, r *http.Request) {
+	var shards []*trackerShard
+	switch r.FormValue("proto") {
+	case "1":
+		shards = proto1_shards
+	case "2":
+		shards = proto2_shards
+	default:
+		http.Error(w, "proto must be 1 or 2", http.StatusBadRequest)
+		return
+	}
+	if *es_seen_set != "map" {
+		http.Error(w, fmt.Sprintf("the %s seen set doesn't keep the ids", *es_seen_set), http.StatusConflict)
+		return
+	}
+	// get all ids before we write any, so that we can still fail the request
+	var dumps [][]string
+	timeout := time.After(seenDumpTimeout)
+	for _, shard := range shards {
+		resp := make(chan []string, 1)
+		select {
+		case shard.dump <- resp:
+		case <-shard.done:
+			http.Error(w, "the trackers have stopped, we're shutting down", http.StatusServiceUnavailable)
+			return
+		case <-timeout:
+			http.Error(w, "the trackers are too busy to list their ids, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		dumps = append(dumps, <-resp)
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	bw := bufio.NewWriter(w)
+	for _, ids := range dumps {
+		for _, id := range ids {
+			bw.WriteString(id)
+			bw.WriteByte('\n')
+		}
+	}
+	bw.Flush()
+}
+
+// fetchSeen gets the seen ids for a protocol from the carbon-tagger with the given stats http address
+func fetchSeen(addr string, proto int) ([]string, error) {
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		addr = "http://" + addr
+	}
+	resp, err := http.Get(fmt.Sprintf("%s/admin/seen?proto=%d", addr, proto))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(msg))
+	}
+	var ids []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		ids = append(ids, scanner.Text())
+	}
+	return ids, scanner.Err()
+}
+
+// loadSeen gets the seen ids for a protocol from the seen caches in dir
+func loadSeen(dir string, proto int) ([]string, error) {
+	var all []string
+	for i := 0; i < *es_trackers; i++ {
+		ids, err := loadSeenIds(dir, shardName(proto, i, *es_trackers))
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, ids...)
+	}
+	return all, nil
+}
+
+func reconcile(conn *elastigo.Conn, args []string) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	from := flags.String("from", "", "stats http address of a running carbon-tagger to get the seen ids from. by default, they're loaded from elasticsearch.cache_dir")
+	dryRun := flags.Bool("dry-run", false, "only report, don't resubmit missing metrics")
+	flags.Parse(args)
+
+	if *es_seen_set != "map" {
+		dieIfError(fmt.Errorf("reconcile needs elasticsearch.seen_set = \"map\", the %s seen set doesn't keep the ids", *es_seen_set))
+	}
+	if *from == "" && *es_cache_dir == "" {
+		dieIfError(fmt.Errorf("reconcile needs -from or elasticsearch.cache_dir"))
+	}
+
+	// id -> proto, of the ids that we haven't found in the index (yet)
+	missing := make(map[string]int)
+	for proto := 1; proto <= 2; proto++ {
+		var ids []string
+		var err error
+		if *from != "" {
+			ids, err = fetchSeen(*from, proto)
+		} else {
+			ids, err = loadSeen(*es_cache_dir, proto)
+		}
+		dieIfError(err)
+		for _, id := range ids {
+			missing[id] = proto
+		}
+	}
+	seen := len(missing)
+	fmt.Printf("reconcile: %d seen ids. comparing with index %s\n", seen, *es_index_name)
+
+	present, extra := 0, 0
+	err := scrollIds(conn, *es_index_name, func(ids []string, inIndex int) bool {
+		for _, id := range ids {
+			if _, ok := missing[id]; ok {
+				delete(missing, id)
+				present++
+			} else {
+				extra++
+			}
+		}
+		return true
+	})
+	dieIfError(err)
+
+	fmt.Printf("present  %d\n", present)
+	fmt.Printf("missing  %d\n", len(missing))
+	fmt.Printf("extra    %d\n", extra)
+	if *dryRun {
+		if isVerbose() {
+			for id := range missing {
+				fmt.Println("missing:", id)
+			}
+		}
+		fmt.Println("re-sent  0 (dry run)")
+		return
+	}
+
+	err = openDeadLetters(*es_dead_letter)
+	dieIfError(err)
+	flushInt := time.Duration(*es_flush_int) * time.Second
+	backoff := time.Duration(*es_backoff) * time.Millisecond
+	es := newEsConnection(conn)
+	indexer1 := NewBulkIndexer(es, *es_index_name, *es_legacy_pol, *es_schema, 1, 4, *es_max_pending, flushInt, *es_max_retries, backoff)
+	indexer1.Start()
+	indexer2 := NewBulkIndexer(es, *es_index_name, *es_tagged_pol, *es_schema, 2, 4, *es_max_pending, flushInt, *es_max_retries, backoff)
+	indexer2.Start()
+	resent, invalid := 0, 0
+	for id, proto := range missing {
+		if proto == 1 {
+			err = indexer1.Index(id, nil)
+		} else {
+			var metric *m20.MetricSpec
+			if isTaggedSeries(id) {
+				metric, err = parseTaggedSeries(id, false)
+			} else {
+				metric, err = m20.NewMetricSpec(id)
+			}
+			if err != nil {
+				fmt.Printf("WARN can't resubmit %s: %s\n", id, err.Error())
+				invalid++
+				continue
+			}
+			err = indexer2.Index(metric.Id, metric)
+		}
+		dieIfError(err)
+		resent++
+	}
+	indexer1.Stop()
+	indexer2.Stop()
+	indexed := indexer1.indexed.Count() + indexer2.indexed.Count()
+	existing := indexer1.existing.Count() + indexer2.existing.Count()
+	failed := indexer1.failed.Count() + indexer2.failed.Count()
+	fmt.Printf("re-sent  %d (indexed %d, existing %d, failed %d, invalid %d)\n", resent, indexed, existing, failed, invalid)
+	if failed > 0 || invalid > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSeenHandler(t *testing.T) {
+	defer func(orig []*trackerShard) { proto1_shards = orig }(proto1_shards)
+	proto1_shards = benchShards(1, 2)
+	ids := seenTestIds(10)
+	for _, id := range ids {
+		proto1_shards[shardFor(id, 2)].seen.add(id)
+	}
+	indexer := benchIndexer(1)
+	trackers.Add(2)
+	for _, shard := range proto1_shards {
+		go trackProto1(shard, indexer)
+	}
+	defer func() {
+		closeTrackers()
+		trackers.Wait()
+		close(indexer.docs)
+	}()
+	srv := httptest.NewServer(http.HandlerFunc(seenHandler))
+	defer srv.Close()
+
+	got, err := fetchSeen(srv.URL, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	sort.Strings(ids)
+	if strings.Join(got, " ") != strings.Join(ids, " ") {
+		t.Errorf("got seen ids %v, want %v", got, ids)
+	}
+	if _, err := fetchSeen(srv.URL, 3); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("got %v for proto 3, want a 400", err)
+	}
+
+	defer func(orig string) { *es_seen_set = orig }(*es_seen_set)
+	*es_seen_set = "bloom"
+	if _, err := fetchSeen(srv.URL, 1); err == nil || !strings.Contains(err.Error(), "409") {
+		t.Errorf("got %v for a bloom seen set, want a 409", err)
+	}
+}
+
+func TestLoadSeen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(orig int) { *es_trackers = orig }(*es_trackers)
+	*es_trackers = 2
+
+	ids := seenTestIds(10)
+	for i := 0; i < 2; i++ {
+		cache, err := NewSeenCache(dir, shardName(1, i, 2), "map", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range ids {
+			if shardFor(id, 2) == i {
+				cache.add(id)
+			}
+		}
+		cache.close()
+	}
+	got, err := loadSeen(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	if strings.Join(got, " ") != strings.Join(ids, " ") {
+		t.Errorf("loaded seen ids %v, want %v", got, ids)
+	}
+}
+
+// seenHandler gives up on trackers that are gone or too busy, rather than hang
+func TestSeenHandlerUnavailable(t *testing.T) {
+	defer func(orig []*trackerShard) { proto1_shards = orig }(proto1_shards)
+	defer func(orig time.Duration) { seenDumpTimeout = orig }(seenDumpTimeout)
+	seenDumpTimeout = 10 * time.Millisecond
+	srv := httptest.NewServer(http.HandlerFunc(seenHandler))
+	defer srv.Close()
+
+	// nobody answers the shards: like trackers that are stuck on the indexer
+	proto1_shards = benchShards(1, 2)
+	if _, err := fetchSeen(srv.URL, 1); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("got %v for busy trackers, want a 503", err)
+	}
+
+	// the trackers have returned, as we're shutting down
+	indexer := benchIndexer(1)
+	trackers.Add(2)
+	for _, shard := range proto1_shards {
+		go trackProto1(shard, indexer)
+	}
+	closeTrackers()
+	trackers.Wait()
+	close(indexer.docs)
+	seenDumpTimeout = time.Hour
+	if _, err := fetchSeen(srv.URL, 1); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("got %v for stopped trackers, want a 503", err)
+	}
+}
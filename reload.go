@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/vimeo/carbon-tagger/_third_party/github.com/Dieterbe/go-metrics"
+	elastigo "github.com/vimeo/carbon-tagger/_third_party/github.com/mattbaird/elastigo/lib"
+	"github.com/vimeo/carbon-tagger/_third_party/github.com/pelletier/go-toml"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// reloading the config file, on SIGHUP or a POST to /admin/reload on the stats http address.
+// we compare the file with what we loaded before, and apply the settings that can be changed live
+// (see reloadable). changes to other settings are reported as requiring a restart.
+// the routing table is always re-read, so it can be changed without touching the config file.
+// if any of the new settings is invalid, nothing is applied.
+// the config vars keep the values we started with, as they're read without locking.
+// what we run with is in live_settings, which only reloadConfig changes, under reload_lock.
+
+var reloadable = map[string]bool{
+	"verbose":              true,
+	"stats.host":           true,
+	"stats.port":           true,
+	"stats.flush_interval": true,
+	"elasticsearch.host":   true,
+	"elasticsearch.port":   true,
+	"out.routes_file":      true,
+}
+
+// liveSettings are the values of the reloadable settings that we run with
+type liveSettings struct {
+	verbose       bool // the setting. -verbose overrides it
+	statsHost     string
+	statsPort     int
+	statsInterval int
+	esHost        string
+	esPort        int
+	routesFile    string
+}
+
+var (
+	loaded_config map[string]string // settings as found in the config file we run with
+	live_settings liveSettings
+	reload_lock   sync.Mutex
+	es_conn       *esConnection
+	stats_config  = make(chan metrics.GraphiteConfig, 1) // see setStatsConfig
+)
+
+// startSettings returns the reloadable settings as we started with them
+func startSettings() liveSettings {
+	return liveSettings{
+		verbose:       *cfg_verbose,
+		statsHost:     *stats_host,
+		statsPort:     *stats_port,
+		statsInterval: *stats_flush_interval,
+		esHost:        *es_host,
+		esPort:        *es_port,
+		routesFile:    *out_routes_file,
+	}
+}
+
+// readConfigFile returns all settings in the config file, formatted like the config package does
+func readConfigFile(fname string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := toml.Load(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a valid TOML file: %s", fname, err.Error())
+	}
+	settings := make(map[string]string)
+	var walk func(tree *toml.TomlTree, prefix string)
+	walk = func(tree *toml.TomlTree, prefix string) {
+		for _, key := range tree.Keys() {
+			value := tree.Get(key)
+			if subtree, ok := value.(*toml.TomlTree); ok {
+				walk(subtree, prefix+key+".")
+				continue
+			}
+			settings[prefix+key] = fmt.Sprintf("%v", value)
+		}
+	}
+	walk(tree, "")
+	return settings, nil
+}
+
+// newEsConn returns a connection to the elasticsearch host(s), which may be a space separated list
+func newEsConn(hosts string, port int) *elastigo.Conn {
+	conn := elastigo.NewConn()
+	conn.SetPort(strconv.Itoa(port))
+	var list []string
+	for _, host := range strings.Fields(hosts) {
+		list = append(list, fmt.Sprintf("%s:%d", host, port))
+	}
+	conn.SetHosts(list)
+	return conn
+}
+
+// esConnection holds the connection the bulk indexers use. elastigo connections can't have their hosts
+// changed while requests are in flight, so on reload we swap in a new connection instead.
+// requests that are already underway finish on the old one.
+type esConnection struct {
+	conn atomic.Value // *elastigo.Conn
+}
+
+func newEsConnection(conn *elastigo.Conn) *esConnection {
+	e := &esConnection{}
+	e.set(conn)
+	return e
+}
+
+func (e *esConnection) get() *elastigo.Conn {
+	return e.conn.Load().(*elastigo.Conn)
+}
+
+func (e *esConnection) set(conn *elastigo.Conn) {
+	e.conn.Store(conn)
+}
+
+func statsConfig(addr *net.TCPAddr, interval int) metrics.GraphiteConfig {
+	return metrics.GraphiteConfig{
+		Addr:          addr,
+		Registry:      metrics.DefaultRegistry,
+		FlushInterval: time.Duration(interval) * time.Second,
+		DurationUnit:  time.Nanosecond,
+		Percentiles:   []float64{0.5, 0.75, 0.95, 0.99, 0.999},
+	}
+}
+
+// setStatsConfig hands new settings to reportStats. if it hasn't picked up the previous ones yet, they're replaced,
+// so that we never wait for it, as it may be busy submitting.
+func setStatsConfig(c metrics.GraphiteConfig) {
+	for {
+		select {
+		case stats_config <- c:
+			return
+		default:
+		}
+		select {
+		case <-stats_config:
+		default:
+		}
+	}
+}
+
+// reportStats submits our stats to graphite, like metrics.Graphite, but takes new settings from stats_config
+func reportStats(c metrics.GraphiteConfig) {
+	ticker := time.NewTicker(c.FlushInterval)
+	for {
+		select {
+		case <-ticker.C:
+			err := metrics.GraphiteOnce(c)
+			if err != nil {
+				fmt.Printf("WARN can't submit stats: %s\n", err.Error())
+			}
+		case c = <-stats_config:
+			ticker.Stop()
+			ticker = time.NewTicker(c.FlushInterval)
+		}
+	}
+}
+
+// reloadConfig re-reads the config file and applies what it can. it returns a report of what it did.
+func reloadConfig() (string, error) {
+	reload_lock.Lock()
+	defer reload_lock.Unlock()
+	settings, err := readConfigFile(*configFile)
+	if err != nil {
+		return "", err
+	}
+	var changed []string
+	for key, val := range settings {
+		if old, ok := loaded_config[key]; !ok || old != val {
+			changed = append(changed, key)
+		}
+	}
+	for key := range loaded_config {
+		if _, ok := settings[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+
+	// start from the running values, and validate the changes
+	cur := live_settings
+	next := cur
+	var apply, restart []string
+	for _, key := range changed {
+		val, ok := settings[key]
+		if !reloadable[key] || !ok {
+			// removed settings would go back to their default, which we only do on restart
+			restart = append(restart, key)
+			continue
+		}
+		switch key {
+		case "verbose":
+			next.verbose, err = strconv.ParseBool(val)
+		case "stats.host":
+			next.statsHost = val
+		case "stats.port":
+			next.statsPort, err = strconv.Atoi(val)
+		case "stats.flush_interval":
+			next.statsInterval, err = strconv.Atoi(val)
+			if err == nil && next.statsInterval < 1 {
+				err = errors.New("must be at least 1")
+			}
+		case "elasticsearch.host":
+			next.esHost = val
+			if strings.TrimSpace(val) == "" {
+				err = errors.New("need at least one host")
+			}
+		case "elasticsearch.port":
+			next.esPort, err = strconv.Atoi(val)
+		case "out.routes_file":
+			next.routesFile = val
+		}
+		if err != nil {
+			return "", fmt.Errorf("invalid value '%s' for %s: %s", val, key, err.Error())
+		}
+		apply = append(apply, key)
+	}
+	statsAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", next.statsHost, next.statsPort))
+	if err != nil {
+		return "", fmt.Errorf("invalid stats address: %s", err.Error())
+	}
+	var newRoutes []*rule
+	if next.routesFile != "" {
+		newRoutes, err = parseRoutes(next.routesFile, destinations)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// all good. apply
+	report := ""
+	for _, key := range apply {
+		report += fmt.Sprintf("applied %s = %s\n", key, settings[key])
+		loaded_config[key] = settings[key]
+	}
+	live_settings = next
+	setVerbose(verbose_flag || next.verbose)
+	if next.statsHost != cur.statsHost || next.statsPort != cur.statsPort || next.statsInterval != cur.statsInterval {
+		setStatsConfig(statsConfig(statsAddr, next.statsInterval))
+	}
+	if next.esHost != cur.esHost || next.esPort != cur.esPort {
+		es_conn.set(newEsConn(next.esHost, next.esPort))
+	}
+	registerRouteStats(newRoutes)
+	routes_lock.Lock()
+	routes = newRoutes
+	routes_lock.Unlock()
+	if next.routesFile != "" {
+		report += fmt.Sprintf("reloaded %d rules from %s\n", len(newRoutes), next.routesFile)
+	}
+	for _, key := range restart {
+		report += fmt.Sprintf("requires restart: %s\n", key)
+	}
+	return report, nil
+}
+
+// reloadHandler implements /admin/reload
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report, err := reloadConfig()
+	if err != nil {
+		http.Error(w, "reload failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprint(w, report)
+}
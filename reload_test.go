@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "carbon-tagger.conf")
+	write := func(conf string) {
+		if err := ioutil.WriteFile(fname, []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(file string, settings map[string]string, live liveSettings, conn *esConnection, v bool) {
+		*configFile, loaded_config, live_settings, es_conn = file, settings, live, conn
+		setVerbose(v)
+	}(*configFile, loaded_config, live_settings, es_conn, isVerbose())
+	*configFile = fname
+	setVerbose(false)
+	live_settings = liveSettings{statsHost: "localhost", statsPort: 2005, statsInterval: 10, esHost: "localhost", esPort: 9200}
+	es_conn = newEsConnection(newEsConn("localhost", 9200))
+	write("verbose = false\n[in]\nport = 2003\n[elasticsearch]\nhost = \"localhost\"\nport = 9200\n")
+	loaded_config, err = readConfigFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("verbose = true\n[in]\nport = 2004\n[elasticsearch]\nhost = \"localhost\"\nport = 9201\n")
+	report, err := reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "applied elasticsearch.port = 9201\napplied verbose = true\nrequires restart: in.port\n"
+	if report != want {
+		t.Errorf("got report %q, want %q", report, want)
+	}
+	if !isVerbose() || live_settings.esPort != 9201 || es_conn.get().Port != "9201" {
+		t.Errorf("after the reload, verbose is %v, the es port %d and the es connection's port %s", isVerbose(), live_settings.esPort, es_conn.get().Port)
+	}
+
+	// nothing is applied if anything is invalid
+	write("verbose = false\n[in]\nport = 2004\n[elasticsearch]\nhost = \"localhost\"\nport = \"x\"\n")
+	_, err = reloadConfig()
+	if err == nil || !strings.Contains(err.Error(), "elasticsearch.port") {
+		t.Fatalf("got error %v, want one about elasticsearch.port", err)
+	}
+	if !isVerbose() || live_settings.esPort != 9201 {
+		t.Errorf("after a failed reload, verbose is %v and the es port %d", isVerbose(), live_settings.esPort)
+	}
+
+	// new stats settings replace the ones reportStats hasn't picked up yet, rather than wait for it
+	for _, port := range []int{2006, 2007} {
+		write(fmt.Sprintf("verbose = true\n[in]\nport = 2004\n[elasticsearch]\nhost = \"localhost\"\nport = 9201\n[stats]\nport = %d\n", port))
+		_, err = reloadConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case c := <-stats_config:
+		if c.Addr.Port != 2007 {
+			t.Errorf("reportStats gets stats port %d, want 2007", c.Addr.Port)
+		}
+	default:
+		t.Error("reportStats gets no new stats settings")
+	}
+}
+
+// the bulk senders keep using the connection while a reload swaps it. run with -race
+func TestEsConnectionSwap(t *testing.T) {
+	es := newEsConnection(newEsConn("es1", 9200))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				conn := es.get()
+				if conn.Port != "9200" && conn.Port != "9201" {
+					t.Errorf("connection has port %s", conn.Port)
+					return
+				}
+			}
+		}()
+	}
+	for j := 0; j < 100; j++ {
+		es.set(newEsConn("es2 es3", 9201))
+	}
+	wg.Wait()
+	conn := es.get()
+	if conn.Port != "9201" || len(conn.Hosts) != 2 || conn.Hosts[0] != "es2:9201" {
+		t.Fatalf("connection has port %s and hosts %v after the swap", conn.Port, conn.Hosts)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// a consistent hashing ring that places metrics on destinations exactly like carbon-relay does
+// (carbon's ConsistentHashRing), so that carbon-tagger can take the place of the relay in front of
+// a set of carbon-caches without metrics moving to different caches.
+// like in carbon, a destination's position on the ring depends on its host and instance, not on its port.
+//
+// supported hash types:
+// * carbon_ch (carbon's default, aka relay method "consistent-hashing"): first 2 bytes of the md5 digest.
+//   replicas are keyed as "('<host>', '<instance>'):<i>" (or "('<host>', None):<i>" without instance)
+// * fnv1a_ch: 32bit fnv1a, folded into 16 bits. replicas are keyed as "<i>-<instance>".
+//   carbon requires an instance on every destination for this hash type, so do we.
+
+const ringReplicas = 100 // carbon's default replica_count
+
+type ringEntry struct {
+	pos  int
+	dest *destination
+}
+
+type hashRing struct {
+	hashType          string
+	entries           []ringEntry // sorted by position
+	numDests          int
+	replicationFactor int
+}
+
+func NewHashRing(hashType string, dests []*destination, replicationFactor int) (*hashRing, error) {
+	if hashType == "consistent-hashing" {
+		hashType = "carbon_ch"
+	}
+	if hashType != "carbon_ch" && hashType != "fnv1a_ch" {
+		return nil, fmt.Errorf("unsupported hash type '%s'", hashType)
+	}
+	if len(dests) == 0 {
+		return nil, fmt.Errorf("%s routing needs at least one destination", hashType)
+	}
+	if replicationFactor < 1 {
+		return nil, fmt.Errorf("replication factor must be at least 1")
+	}
+	r := &hashRing{
+		hashType:          hashType,
+		numDests:          len(dests),
+		replicationFactor: replicationFactor,
+	}
+	for _, dest := range dests {
+		if hashType == "fnv1a_ch" && dest.instance == "" {
+			return nil, fmt.Errorf("destination %s has no instance, which fnv1a_ch requires", dest.addr)
+		}
+		r.add(dest)
+	}
+	return r, nil
+}
+
+func (r *hashRing) position(key string) int {
+	if r.hashType == "fnv1a_ch" {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		big := h.Sum32()
+		return int((big >> 16) ^ (big & 0xffff))
+	}
+	sum := md5.Sum([]byte(key))
+	return int(sum[0])<<8 | int(sum[1])
+}
+
+func (r *hashRing) replicaKey(dest *destination, i int) string {
+	if r.hashType == "fnv1a_ch" {
+		return fmt.Sprintf("%d-%s", i, dest.instance)
+	}
+	// this is python's str() of carbon's (server, instance) tuple
+	if dest.instance == "" {
+		return fmt.Sprintf("('%s', None):%d", dest.host(), i)
+	}
+	return fmt.Sprintf("('%s', '%s'):%d", dest.host(), dest.instance, i)
+}
+
+func (r *hashRing) add(dest *destination) {
+	for i := 0; i < ringReplicas; i++ {
+		pos := r.position(r.replicaKey(dest, i))
+		// like carbon, resolve collisions by moving up until we find a free spot
+		for r.taken(pos) {
+			pos++
+		}
+		idx := sort.Search(len(r.entries), func(j int) bool { return r.entries[j].pos >= pos })
+		r.entries = append(r.entries, ringEntry{})
+		copy(r.entries[idx+1:], r.entries[idx:])
+		r.entries[idx] = ringEntry{pos, dest}
+	}
+}
+
+func (r *hashRing) taken(pos int) bool {
+	idx := sort.Search(len(r.entries), func(j int) bool { return r.entries[j].pos >= pos })
+	return idx < len(r.entries) && r.entries[idx].pos == pos
+}
+
+// getDestinations returns the destinations for the given metric id:
+// the first replicationFactor distinct destinations found walking the ring from the id's position.
+func (r *hashRing) getDestinations(id string) []*destination {
+	pos := r.position(id)
+	idx := sort.Search(len(r.entries), func(j int) bool { return r.entries[j].pos >= pos }) % len(r.entries)
+	if r.replicationFactor == 1 {
+		return []*destination{r.entries[idx].dest}
+	}
+	want := r.replicationFactor
+	if want > r.numDests {
+		want = r.numDests
+	}
+	dests := make([]*destination, 0, want)
+	for i := 0; i < len(r.entries) && len(dests) < want; i++ {
+		dest := r.entries[(idx+i)%len(r.entries)].dest
+		seen := false
+		for _, d := range dests {
+			if d == dest {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			dests = append(dests, dest)
+		}
+	}
+	return dests
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"testing"
+)
+
+func testDestinations(specs ...string) []*destination {
+	var dests []*destination
+	for _, spec := range specs {
+		addr, instance, _ := splitDestination(spec)
+		dests = append(dests, &destination{spec: spec, addr: addr, instance: instance})
+	}
+	return dests
+}
+
+// the positions and nodes carbon's own tests (carbon/tests/test_hashing.py) expect
+func TestRingCarbonTestVectors(t *testing.T) {
+	positions := []struct {
+		hashType string
+		key      string
+		pos      int
+	}{
+		{"carbon_ch", "hosts.worker1.cpu", 64833},
+		{"carbon_ch", "hosts.worker2.cpu", 38509},
+		{"fnv1a_ch", "hosts.worker1.cpu", 59573},
+		{"fnv1a_ch", "hosts.worker1.load", 57163},
+	}
+	for _, c := range positions {
+		r := &hashRing{hashType: c.hashType}
+		if pos := r.position(c.key); pos != c.pos {
+			t.Errorf("%s position of %s is %d, want %d", c.hashType, c.key, pos, c.pos)
+		}
+	}
+
+	dests := testDestinations(
+		"127.0.0.1:2004:ba603c36342304ed77953f84ac4d357b",
+		"127.0.0.2:2004:5dd63865534f84899c6e5594dba6749a",
+		"127.0.0.3:2004:866a18b81f2dc4649517a1df13e26f28",
+	)
+	r, err := NewHashRing("fnv1a_ch", dests, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := []struct {
+		key  string
+		dest int
+	}{
+		{"hosts.worker1.cpu", 0},
+		{"hosts.worker2.cpu", 2},
+	}
+	for _, c := range nodes {
+		if got := r.getDestinations(c.key)[0]; got != dests[c.dest] {
+			t.Errorf("%s goes to %s, want %s", c.key, got.spec, dests[c.dest].spec)
+		}
+	}
+}
+
+// a metric id, and the indexes of the destinations it goes to with replication factor 1 and 2
+type ringKey struct {
+	key string
+	rf1 int
+	rf2 []int
+}
+
+// what carbon-relay's ConsistentHashRing (carbon 1.1) picks for these rings, with replication factor 1 and 2
+func TestRingMatchesCarbon(t *testing.T) {
+	cases := []struct {
+		hashType string
+		specs    []string
+		keys     []ringKey
+	}{
+		{
+			"carbon_ch",
+			// the port doesn't matter for the placement
+			[]string{"10.0.0.1:2004", "10.0.0.2:2014", "10.0.0.3:2004:x"},
+			[]ringKey{
+				{"carbon.agents.host1.cpuUsage", 1, []int{1, 0}},
+				{"servers.web1.cpu.user", 2, []int{2, 0}},
+				{"servers.web2.cpu.user", 0, []int{0, 1}},
+				{"stats.counters.api.requests.count", 1, []int{1, 0}},
+				{"collectd.db1.memory.used", 0, []int{0, 1}},
+				{"a", 1, []int{1, 2}},
+				{"a.b.c", 2, []int{2, 1}},
+				{"some.metric.42.foo", 0, []int{0, 1}},
+				{"unit_is_B.what_is_mem.server_is_web1", 1, []int{1, 2}},
+				{"disk.sda.read_bytes;host=db1", 2, []int{2, 1}},
+			},
+		},
+		{
+			"fnv1a_ch",
+			[]string{"10.0.0.1:2004:a", "10.0.0.2:2004:b", "10.0.0.3:2004:c"},
+			[]ringKey{
+				{"carbon.agents.host1.cpuUsage", 0, []int{0, 1}},
+				{"servers.web1.cpu.user", 0, []int{0, 2}},
+				{"servers.web2.cpu.user", 2, []int{2, 0}},
+				{"stats.counters.api.requests.count", 0, []int{0, 1}},
+				{"collectd.db1.memory.used", 0, []int{0, 1}},
+				{"a", 0, []int{0, 2}},
+				{"a.b.c", 0, []int{0, 1}},
+				{"some.metric.42.foo", 1, []int{1, 2}},
+				{"unit_is_B.what_is_mem.server_is_web1", 0, []int{0, 2}},
+				{"disk.sda.read_bytes;host=db1", 0, []int{0, 1}},
+			},
+		},
+	}
+	for _, c := range cases {
+		dests := testDestinations(c.specs...)
+		r1, err := NewHashRing(c.hashType, dests, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r2, err := NewHashRing(c.hashType, dests, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range c.keys {
+			got := r1.getDestinations(k.key)
+			if len(got) != 1 || got[0] != dests[k.rf1] {
+				t.Errorf("%s: %s goes to %v, want %s", c.hashType, k.key, destSpecs(got), dests[k.rf1].spec)
+			}
+			got = r2.getDestinations(k.key)
+			var want []*destination
+			for _, i := range k.rf2 {
+				want = append(want, dests[i])
+			}
+			if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+				t.Errorf("%s: with replication 2, %s goes to %v, want %v", c.hashType, k.key, destSpecs(got), destSpecs(want))
+			}
+		}
+	}
+}
+
+func destSpecs(dests []*destination) []string {
+	var out []string
+	for _, d := range dests {
+		out = append(out, d.spec)
+	}
+	return out
+}
+
+func TestRingReplication(t *testing.T) {
+	dests := testDestinations("10.0.0.1:2004", "10.0.0.2:2004")
+	// more replicas than destinations: every destination once
+	r, err := NewHashRing("carbon_ch", dests, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := r.getDestinations("a.b.c")
+	if len(got) != 2 || got[0] == got[1] {
+		t.Fatalf("expected both destinations once, got %v", destSpecs(got))
+	}
+
+	single := testDestinations("10.0.0.1:2004")
+	r, err = NewHashRing("carbon_ch", single, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.getDestinations("a.b.c"); len(got) != 1 || got[0] != single[0] {
+		t.Fatalf("expected the only destination, got %v", destSpecs(got))
+	}
+}
+
+func TestRingInvalid(t *testing.T) {
+	if _, err := NewHashRing("fnv1a_ch", testDestinations("10.0.0.1:2004"), 1); err == nil {
+		t.Error("fnv1a_ch without instance should fail")
+	}
+	if _, err := NewHashRing("md5", testDestinations("10.0.0.1:2004"), 1); err == nil {
+		t.Error("unknown hash type should fail")
+	}
+	if _, err := NewHashRing("carbon_ch", nil, 1); err == nil {
+		t.Error("ring without destinations should fail")
+	}
+	if _, err := NewHashRing("carbon_ch", testDestinations("10.0.0.1:2004"), 0); err == nil {
+		t.Error("replication factor 0 should fail")
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	m20 "github.com/metrics20/go-metrics20"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// a routing table decides which destinations get which lines, similar to carbon-c-relay's match rules.
+// it is read from a file with one rule per line:
+//
+//   match <matcher> [<matcher> ...] send to <target> [<target> ...] [stop]
+//   match <matcher> [<matcher> ...] drop
+//
+// a rule matches when all its matchers match. matchers:
+//   *                     matches everything
+//   prefix <str>          the metric id starts with str
+//   regex <re>            the metric id matches re (no whitespace allowed, use \s)
+//   proto <1|2>           the line was classified as proto1 or proto2 (which includes tagged series)
+//   tag <key>=<value>     proto2 metric with this tag. value may be * to match any value
+// targets are destinations exactly as listed in out.destinations, or "default", which means
+// what out.routing says (all destinations, or the consistent hashing ring).
+// rules are evaluated top to bottom. a matching rule sends the line to its targets, and unless it
+// says "stop" (or "drop", which also stops), evaluation continues with the next rule.
+// lines that no rule sends anywhere are not forwarded at all.
+
+type matcher func(id string, proto int, metric *m20.MetricSpec) bool
+
+type rule struct {
+	matchers   []matcher
+	dests      []*destination
+	useDefault bool
+	drop       bool
+	stop       bool
+	hits       stat
+}
+
+var routes []*rule // nil means no routing table: every line goes to the default destinations
+var routes_lock sync.RWMutex
+var rule_hits []stat
+var unrouted stat
+
+func (r *rule) match(id string, proto int, metric *m20.MetricSpec) bool {
+	for _, m := range r.matchers {
+		if !m(id, proto, metric) {
+			return false
+		}
+	}
+	return true
+}
+
+func parseMatcher(kind, arg string) (matcher, error) {
+	switch kind {
+	case "prefix":
+		return func(id string, proto int, metric *m20.MetricSpec) bool {
+			return strings.HasPrefix(id, arg)
+		}, nil
+	case "regex":
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, err
+		}
+		return func(id string, proto int, metric *m20.MetricSpec) bool {
+			return re.MatchString(id)
+		}, nil
+	case "proto":
+		want, err := strconv.Atoi(arg)
+		if err != nil || (want != 1 && want != 2) {
+			return nil, fmt.Errorf("proto must be 1 or 2, not '%s'", arg)
+		}
+		return func(id string, proto int, metric *m20.MetricSpec) bool {
+			return proto == want
+		}, nil
+	case "tag":
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("tag matcher needs key=value, not '%s'", arg)
+		}
+		key, val := kv[0], kv[1]
+		return func(id string, proto int, metric *m20.MetricSpec) bool {
+			if metric == nil {
+				return false
+			}
+			v, ok := metric.Tags[key]
+			return ok && (val == "*" || v == val)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown matcher '%s'", kind)
+}
+
+// parseRule parses a rule (the part after "match")
+func parseRule(fields []string, dests []*destination) (*rule, error) {
+	r := &rule{}
+	i := 0
+	for ; i < len(fields); i++ {
+		if fields[i] == "send" || fields[i] == "drop" {
+			break
+		}
+		if fields[i] == "*" {
+			r.matchers = append(r.matchers, func(id string, proto int, metric *m20.MetricSpec) bool { return true })
+			continue
+		}
+		if i+1 == len(fields) {
+			return nil, fmt.Errorf("matcher '%s' needs an argument", fields[i])
+		}
+		m, err := parseMatcher(fields[i], fields[i+1])
+		if err != nil {
+			return nil, err
+		}
+		r.matchers = append(r.matchers, m)
+		i++
+	}
+	if len(r.matchers) == 0 {
+		return nil, fmt.Errorf("no matchers")
+	}
+	if i == len(fields) {
+		return nil, fmt.Errorf("need 'send to' or 'drop'")
+	}
+	if fields[i] == "drop" {
+		if i+1 != len(fields) {
+			return nil, fmt.Errorf("unexpected '%s' after drop", fields[i+1])
+		}
+		r.drop = true
+		r.stop = true
+		return r, nil
+	}
+	if i+1 == len(fields) || fields[i+1] != "to" {
+		return nil, fmt.Errorf("expected 'send to'")
+	}
+	targets := fields[i+2:]
+	if len(targets) > 0 && targets[len(targets)-1] == "stop" {
+		r.stop = true
+		targets = targets[:len(targets)-1]
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no targets")
+	}
+	for _, target := range targets {
+		if target == "default" {
+			r.useDefault = true
+			continue
+		}
+		found := false
+		for _, dest := range dests {
+			if dest.spec == target {
+				r.dests = append(r.dests, dest)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown destination '%s'", target)
+		}
+	}
+	return r, nil
+}
+
+// parseRoutes reads the routing table from the given file
+func parseRoutes(fname string, dests []*destination) ([]*rule, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rules []*rule
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if fields[0] != "match" {
+			return nil, fmt.Errorf("%s line %d: rules must start with 'match'", fname, lineNum)
+		}
+		r, err := parseRule(fields[1:], dests)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", fname, lineNum, err.Error())
+		}
+		rules = append(rules, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// registerRouteStats sets up the hit counters for the rules. they are identified by their position in the table,
+// so when the table is reloaded, a rule takes over the counter of the rule that was at its position.
+func registerRouteStats(rules []*rule) {
+	for i, r := range rules {
+		if i == len(rule_hits) {
+			rule_hits = append(rule_hits, NewCounter(fmt.Sprintf("unit_is_Metric.direction_is_out.type_is_rule_hit.rule_is_%d", i+1), false))
+		}
+		r.hits = rule_hits[i]
+	}
+	if unrouted.val == nil {
+		unrouted = NewCounter("unit_is_Metric.direction_is_out.type_is_unrouted", false)
+	}
+}
+
+// route returns the destinations for a line according to the given routing table
+func route(rules []*rule, id string, proto int, metric *m20.MetricSpec) []*destination {
+	var dests []*destination
+	add := func(dest *destination) {
+		for _, d := range dests {
+			if d == dest {
+				return
+			}
+		}
+		dests = append(dests, dest)
+	}
+	for _, r := range rules {
+		if !r.match(id, proto, metric) {
+			continue
+		}
+		r.hits.Inc(1)
+		if r.drop {
+			break
+		}
+		for _, dest := range r.dests {
+			add(dest)
+		}
+		if r.useDefault {
+			for _, dest := range defaultDestinations(id) {
+				add(dest)
+			}
+		}
+		if r.stop {
+			break
+		}
+	}
+	if len(dests) == 0 {
+		unrouted.Inc(1)
+	}
+	return dests
+}
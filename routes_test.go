@@ -0,0 +1,118 @@
+package main
+
+import (
+	m20 "github.com/metrics20/go-metrics20"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// writeRoutes writes a routing table to a temporary file and parses it
+func writeRoutes(table string, dests []*destination) ([]*rule, error) {
+	f, err := ioutil.TempFile("", "routes")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(table)
+	f.Close()
+	return parseRoutes(f.Name(), dests)
+}
+
+func TestRoute(t *testing.T) {
+	dests := testDestinations("10.0.0.1:2003", "10.0.0.2:2003", "10.0.0.3:2003")
+	d1, d2, d3 := dests[0], dests[1], dests[2]
+	defer func(orig []*destination) { destinations = orig }(destinations)
+	destinations = dests
+
+	rules, err := writeRoutes(`# a comment, and an empty line
+
+match prefix test. drop
+match tag unit=Err send to 10.0.0.2:2003 stop
+match proto 2 send to 10.0.0.2:2003
+match regex ^servers\.web[0-9]+\. send to 10.0.0.3:2003
+match prefix servers. tag server=* send to 10.0.0.1:2003
+match * send to default
+`, dests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerRouteStats(rules)
+
+	cases := []struct {
+		id    string
+		proto int
+		want  []*destination
+	}{
+		{"test.foo", 1, nil},
+		{"test.unit_is_Err.what_is_timeouts", 2, nil},
+		{"unit_is_Err.what_is_timeouts", 2, []*destination{d2}},
+		{"unit_is_B.what_is_mem", 2, []*destination{d2, d1, d3}},
+		{"servers.web1.cpu", 1, []*destination{d3, d1, d2}},
+		{"servers.db1.cpu", 1, []*destination{d1, d2, d3}},
+		// a tag matcher never matches proto1 metrics
+		{"servers.server_is_web1", 1, []*destination{d1, d2, d3}},
+		{"other.metric", 1, []*destination{d1, d2, d3}},
+	}
+	for _, c := range cases {
+		var metric *m20.MetricSpec
+		if c.proto == 2 {
+			metric, err = m20.NewMetricSpec(c.id)
+			if err != nil {
+				t.Fatalf("%s: %s", c.id, err)
+			}
+		}
+		got := route(rules, c.id, c.proto, metric)
+		if strings.Join(destSpecs(got), " ") != strings.Join(destSpecs(c.want), " ") {
+			t.Errorf("%s goes to %v, want %v", c.id, destSpecs(got), destSpecs(c.want))
+		}
+	}
+	if hits := rules[0].hits.Count(); hits != 2 {
+		t.Errorf("drop rule has %d hits, want 2", hits)
+	}
+}
+
+func TestRouteUnrouted(t *testing.T) {
+	dests := testDestinations("10.0.0.1:2003")
+	rules, err := writeRoutes("match prefix a. send to 10.0.0.1:2003\n", dests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerRouteStats(rules)
+	before := unrouted.Count()
+	if got := route(rules, "b.c", 1, nil); len(got) != 0 {
+		t.Fatalf("b.c should not be routed, goes to %v", destSpecs(got))
+	}
+	if got := route(rules, "a.c", 1, nil); len(got) != 1 || got[0] != dests[0] {
+		t.Fatalf("a.c goes to %v", destSpecs(got))
+	}
+	if n := unrouted.Count() - before; n != 1 {
+		t.Fatalf("%d unrouted lines counted, want 1", n)
+	}
+}
+
+func TestParseRoutesInvalid(t *testing.T) {
+	dests := testDestinations("10.0.0.1:2003")
+	cases := []string{
+		"route * drop",
+		"match drop",
+		"match send to 10.0.0.1:2003",
+		"match prefix",
+		"match prefix a.",
+		"match prefix a. send 10.0.0.1:2003",
+		"match prefix a. send to",
+		"match prefix a. send to stop",
+		"match prefix a. send to 10.0.0.9:2003",
+		"match prefix a. drop now",
+		"match proto 3 drop",
+		"match tag unit drop",
+		"match regex ( drop",
+		"match suffix a drop",
+	}
+	for _, table := range cases {
+		if _, err := writeRoutes(table+"\n", dests); err == nil {
+			t.Errorf("'%s' should be rejected", table)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	m20 "github.com/metrics20/go-metrics20"
+	"sort"
+	"strings"
+)
+
+// the document schemas, selected with elasticsearch.schema:
+// flat        {"tags": ["unit=B", "server=web1"]}, as metrics 2.0 describes. legacy metrics have no tags.
+// structured  {"tags": {"unit": "B", "server": "web1"}, "tag_keys": ["server", "unit"],
+//              "id": "<the metric id>", "nodes": 2, "proto": 2}
+//             which lets ES aggregate on the values of a tag key, or on the keys, without wildcard queries.
+//             nodes is the number of dot separated nodes in the id (in the name, for tagged series),
+//             proto is 1 for legacy metrics and 2 for metrics 2.0 and tagged series.
+// an index holds documents of one schema, see indexBody for their mappings.
+
+type structuredDoc struct {
+	Tags    map[string]string `json:"tags"`
+	TagKeys []string          `json:"tag_keys"`
+	Id      string            `json:"id"`
+	Nodes   int               `json:"nodes"`
+	Proto   int               `json:"proto"`
+}
+
+// metricDocs returns the document for a metric in the given schema, and the fields of it to merge into
+// an existing document. metric is nil for legacy metrics, whose (lack of) tags we don't merge.
+func metricDocs(schema, id string, metric *m20.MetricSpec) (doc, partial interface{}) {
+	if schema == "flat" {
+		if metric == nil {
+			return m20.MetricEs{Tags: make([]string, 0)}, map[string]interface{}{}
+		}
+		flat := m20.NewMetricEs(*metric)
+		return flat, map[string]interface{}{"tags": flat.Tags}
+	}
+	if metric == nil {
+		nodes := idNodes(id)
+		legacy := structuredDoc{Tags: map[string]string{}, TagKeys: make([]string, 0), Id: id, Nodes: nodes, Proto: 1}
+		return legacy, map[string]interface{}{"id": id, "nodes": nodes, "proto": 1}
+	}
+	structured := structuredDoc{Tags: metric.Tags, TagKeys: tagKeys(metric.Tags), Id: id, Nodes: idNodes(id), Proto: 2}
+	return structured, structured
+}
+
+// idNodes returns the number of nodes in a metric id
+func idNodes(id string) int {
+	if i := strings.IndexByte(id, ';'); i >= 0 {
+		id = id[:i]
+	}
+	return strings.Count(id, ".") + 1
+}
+
+func tagKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// convertSource converts the source of a document from one schema to another. other fields are kept.
+func convertSource(source json.RawMessage, id, from, to string) (json.RawMessage, error) {
+	if from == to {
+		return source, nil
+	}
+	var doc map[string]interface{}
+	err := json.Unmarshal(source, &doc)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		doc = make(map[string]interface{})
+	}
+	if to == "structured" {
+		tags := make(map[string]string)
+		list, _ := doc["tags"].([]interface{})
+		for _, tag := range list {
+			str, _ := tag.(string)
+			kv := strings.SplitN(str, "=", 2)
+			if len(kv) == 2 {
+				tags[kv[0]] = kv[1]
+			}
+		}
+		proto := 1
+		if isTaggedSeries(id) || m20.IsMetric20(id) {
+			proto = 2
+		}
+		doc["tags"] = tags
+		doc["tag_keys"] = tagKeys(tags)
+		doc["id"] = id
+		doc["nodes"] = idNodes(id)
+		doc["proto"] = proto
+	} else {
+		obj, _ := doc["tags"].(map[string]interface{})
+		list := make([]string, 0, len(obj))
+		for key, val := range obj {
+			if str, ok := val.(string); ok {
+				list = append(list, key+"="+str)
+			}
+		}
+		sort.Strings(list)
+		doc["tags"] = list
+		for _, field := range []string{"tag_keys", "id", "nodes", "proto"} {
+			delete(doc, field)
+		}
+	}
+	return json.Marshal(doc)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	m20 "github.com/metrics20/go-metrics20"
+	"testing"
+)
+
+func TestMetricDocs(t *testing.T) {
+	metric := &m20.MetricSpec{Id: "unit_is_B.what_is_mem", Tags: map[string]string{"unit": "B", "what": "mem"}}
+	tagged := &m20.MetricSpec{Id: "disk.read;unit=B", Tags: map[string]string{"unit": "B"}}
+	cases := []struct {
+		schema, id   string
+		metric       *m20.MetricSpec
+		doc, partial string
+	}{
+		{"flat", "a.b.c", nil, `{"tags":[]}`, `{}`},
+		{"flat", "disk.read;unit=B", tagged, `{"tags":["unit=B"]}`, `{"tags":["unit=B"]}`},
+		{"structured", "a.b.c", nil, `{"tags":{},"tag_keys":[],"id":"a.b.c","nodes":3,"proto":1}`, `{"id":"a.b.c","nodes":3,"proto":1}`},
+		{"structured", "unit_is_B.what_is_mem", metric,
+			`{"tags":{"unit":"B","what":"mem"},"tag_keys":["unit","what"],"id":"unit_is_B.what_is_mem","nodes":2,"proto":2}`,
+			`{"tags":{"unit":"B","what":"mem"},"tag_keys":["unit","what"],"id":"unit_is_B.what_is_mem","nodes":2,"proto":2}`},
+		{"structured", "disk.read;unit=B", tagged,
+			`{"tags":{"unit":"B"},"tag_keys":["unit"],"id":"disk.read;unit=B","nodes":2,"proto":2}`,
+			`{"tags":{"unit":"B"},"tag_keys":["unit"],"id":"disk.read;unit=B","nodes":2,"proto":2}`},
+	}
+	for _, c := range cases {
+		doc, partial := metricDocs(c.schema, c.id, c.metric)
+		docJson, _ := json.Marshal(doc)
+		partialJson, _ := json.Marshal(partial)
+		if string(docJson) != c.doc || string(partialJson) != c.partial {
+			t.Errorf("%s %s: got %s and %s, want %s and %s", c.schema, c.id, docJson, partialJson, c.doc, c.partial)
+		}
+	}
+}
+
+// converting a document to the other schema and back gives the same document
+func TestConvertSource(t *testing.T) {
+	cases := []struct {
+		id, flat, structured string
+	}{
+		{"a.b.c", `{"tags":[]}`, `{"id":"a.b.c","nodes":3,"proto":1,"tag_keys":[],"tags":{}}`},
+		{"unit_is_B.what_is_mem", `{"tags":["unit=B","what=mem"]}`, `{"id":"unit_is_B.what_is_mem","nodes":2,"proto":2,"tag_keys":["unit","what"],"tags":{"unit":"B","what":"mem"}}`},
+		{"disk.read;unit=B", `{"other":1,"tags":["unit=B"]}`, `{"id":"disk.read;unit=B","nodes":2,"other":1,"proto":2,"tag_keys":["unit"],"tags":{"unit":"B"}}`},
+	}
+	for _, c := range cases {
+		structured, err := convertSource(json.RawMessage(c.flat), c.id, "flat", "structured")
+		if err != nil || string(structured) != c.structured {
+			t.Errorf("%s to structured: got %s, %v, want %s", c.flat, structured, err, c.structured)
+		}
+		flat, err := convertSource(json.RawMessage(c.structured), c.id, "structured", "flat")
+		if err != nil || string(flat) != c.flat {
+			t.Errorf("%s to flat: got %s, %v, want %s", c.structured, flat, err, c.flat)
+		}
+	}
+	same, err := convertSource(json.RawMessage(`{"tags":["not","json"`), "a.b", "flat", "flat")
+	if err != nil || string(same) != `{"tags":["not","json"` {
+		t.Errorf("converting to the same schema gives %s, %v", same, err)
+	}
+	_, err = convertSource(json.RawMessage(`{"tags":`), "a.b", "flat", "structured")
+	if err == nil {
+		t.Error("converting an invalid document succeeds")
+	}
+}
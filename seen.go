@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// the set of metric ids a tracker has submitted to ES, so it never submits them again.
+// with elasticsearch.cache_dir set, the set survives restarts: every cache_snapshot_interval it's written
+// to a gzipped snapshot file, and in between, new ids are appended to a log file.
+// on startup we load the snapshot and then the log. a crash loses at most the ids that were
+// still buffered for the log, which just get submitted again.
+// note that an id counts as seen once it's handed to the bulk indexer, not once ES has acknowledged it.
+// if the indexer gives up on it, the id is removed again, which the log records as a line with forgetPrefix.
+// bloom filters can't remove ids, so with those, such metrics aren't submitted again.
+// a seenCache is owned by its tracker goroutine, it is not safe for concurrent use, except for reading
+// the memory and fpRate fields, which updateStats sets atomically.
+
+// a snapshot starts with a header line that says which kind of seen set it holds, followed by what the set saves.
+// snapshots from before the header are a list of ids, one per line, like the log.
+const snapshotHeader = "seen-set "
+
+// a log line for an id that was removed. ids never contain spaces.
+const forgetPrefix = "- "
+
+type seenCache struct {
+	memory int64  // estimated memory usage of ids. atomic
+	fpRate uint64 // estimated false positive rate of ids, as float64 bits. atomic
+
+	ids      seenSet
+	snapPath string // empty if we don't persist
+	logPath  string
+	logFile  *os.File
+	log      *bufio.Writer
+
+	restored int           // ids loaded from dir
+	loadTime time.Duration // how long that took
+}
+
+// NewSeenCache returns the seen cache with the given name (which must be unique per tracker), loaded from dir.
+// dir may be empty.
+func NewSeenCache(dir, name string, kind string, fpRate float64) (*seenCache, error) {
+	ids, err := newSeenSet(kind, fpRate)
+	if err != nil {
+		return nil, err
+	}
+	c := &seenCache{ids: ids}
+	c.updateStats()
+	if dir == "" {
+		return c, nil
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	c.snapPath = path.Join(dir, name+".snapshot.gz")
+	c.logPath = path.Join(dir, name+".log")
+
+	pre := time.Now()
+	err = c.loadSnapshot()
+	if err != nil {
+		return nil, fmt.Errorf("can't load %s: %s", c.snapPath, err.Error())
+	}
+	err = c.loadLog()
+	if err != nil {
+		return nil, fmt.Errorf("can't load %s: %s", c.logPath, err.Error())
+	}
+	c.loadTime = time.Since(pre)
+	c.restored = c.ids.len()
+	c.updateStats()
+
+	// start from a fresh snapshot, so that the log only has to hold what's new since this run started
+	err = c.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadSeenIds returns the ids in the persisted seen cache with the given name, leaving its files alone.
+// that only works for map sets, as the others don't keep the ids.
+func loadSeenIds(dir, name string) ([]string, error) {
+	c := &seenCache{
+		ids:      &mapSet{ids: make(map[string]struct{})},
+		snapPath: path.Join(dir, name+".snapshot.gz"),
+		logPath:  path.Join(dir, name+".log"),
+	}
+	err := c.loadSnapshot()
+	if err != nil {
+		return nil, fmt.Errorf("can't load %s: %s", c.snapPath, err.Error())
+	}
+	err = c.loadLog()
+	if err != nil {
+		return nil, fmt.Errorf("can't load %s: %s", c.logPath, err.Error())
+	}
+	ids, _ := c.list()
+	return ids, nil
+}
+
+func (c *seenCache) loadSnapshot() error {
+	f, err := os.Open(c.snapPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(gz)
+	header, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if !strings.HasPrefix(header, snapshotHeader) {
+		// a list of ids without header
+		addId(c.ids, strings.TrimSuffix(header, "\n"))
+		return readIds(r, c.ids, false)
+	}
+	kind := strings.TrimSpace(strings.TrimPrefix(header, snapshotHeader))
+	if kind == c.ids.kind() {
+		err = c.ids.load(r)
+		if err == errBloomFpRate {
+			fmt.Printf("WARN %s holds a bloom filter for another elasticsearch.seen_fp_rate, which can't be resized. ignoring it\n", c.snapPath)
+			return nil
+		}
+		return err
+	}
+	if kind == "map" {
+		return readIds(r, c.ids, false)
+	}
+	fmt.Printf("WARN %s holds a %s seen set, which can't be converted to %s. ignoring it\n", c.snapPath, kind, c.ids.kind())
+	return nil
+}
+
+func (c *seenCache) loadLog() error {
+	f, err := os.Open(c.logPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// we may have crashed halfway through writing a line
+	return readIds(bufio.NewReader(f), c.ids, true)
+}
+
+// readIds adds all ids in r, one per line, to the set. if partialOk, an unterminated last line is skipped.
+func readIds(r *bufio.Reader, set seenSet, partialOk bool) error {
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			if !partialOk {
+				addId(set, line)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		addId(set, strings.TrimSuffix(line, "\n"))
+	}
+}
+
+// addId adds the id on a line of a log or id list, or removes it if the line says so
+func addId(set seenSet, id string) {
+	if strings.HasPrefix(id, forgetPrefix) {
+		set.remove(strings.TrimPrefix(id, forgetPrefix))
+		return
+	}
+	if id != "" && !set.has(id) {
+		set.add(id)
+	}
+}
+
+// list returns all ids, if the set keeps them
+func (c *seenCache) list() ([]string, bool) {
+	set, ok := c.ids.(*mapSet)
+	if !ok {
+		return nil, false
+	}
+	ids := make([]string, 0, len(set.ids))
+	for id := range set.ids {
+		ids = append(ids, id)
+	}
+	return ids, true
+}
+
+func (c *seenCache) has(id string) bool {
+	return c.ids.has(id)
+}
+
+// add adds an id that is not in the cache yet
+func (c *seenCache) add(id string) {
+	c.ids.add(id)
+	if c.log != nil {
+		c.log.WriteString(id)
+		c.log.WriteByte('\n')
+	}
+}
+
+// remove removes an id, so it's submitted again. it returns false if the set can't remove ids.
+func (c *seenCache) remove(id string) bool {
+	if !c.ids.has(id) {
+		return true
+	}
+	if !c.ids.remove(id) {
+		return false
+	}
+	if c.log != nil {
+		c.log.WriteString(forgetPrefix)
+		c.log.WriteString(id)
+		c.log.WriteByte('\n')
+	}
+	return true
+}
+
+func (c *seenCache) updateStats() {
+	atomic.StoreInt64(&c.memory, c.ids.memory())
+	atomic.StoreUint64(&c.fpRate, math.Float64bits(c.ids.fpRate()))
+}
+
+// flush writes out the buffered log, and updates the stats. trackers call it after every batch.
+func (c *seenCache) flush() {
+	c.updateStats()
+	if c.log == nil || c.log.Buffered() == 0 {
+		return
+	}
+	err := c.log.Flush()
+	if err != nil {
+		// the buffer keeps the error, so we stop logging until the next snapshot starts a new log
+		fmt.Printf("WARN can't write to %s: %s. ids seen from now on are lost on restart, until the next snapshot\n", c.logPath, err.Error())
+		c.log = nil
+	}
+}
+
+// snapshot writes all ids to a new snapshot file, which replaces the previous one, and starts a new log
+func (c *seenCache) snapshot() error {
+	if c.snapPath == "" {
+		return nil
+	}
+	tmp := c.snapPath + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	gz := gzip.NewWriter(w)
+	_, err = gz.Write([]byte(snapshotHeader + c.ids.kind() + "\n"))
+	if err == nil {
+		err = c.ids.save(gz)
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, c.snapPath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("can't write snapshot %s: %s", c.snapPath, err.Error())
+	}
+	// everything in the log is in the snapshot now
+	if c.logFile != nil {
+		c.logFile.Close()
+	}
+	c.logFile, err = os.Create(c.logPath)
+	if err != nil {
+		c.log = nil
+		return fmt.Errorf("can't create %s: %s", c.logPath, err.Error())
+	}
+	c.log = bufio.NewWriter(c.logFile)
+	return nil
+}
+
+// close writes a final snapshot
+func (c *seenCache) close() {
+	if c.snapPath == "" {
+		return
+	}
+	c.flush()
+	err := c.snapshot()
+	if err != nil {
+		fmt.Printf("WARN %s\n", err.Error())
+	}
+	if c.logFile != nil {
+		c.logFile.Close()
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func seenTestIds(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("unit_is_B.what_is_test.server_is_web%d", i)
+	}
+	return ids
+}
+
+// ids added before a snapshot, added after it (so only in the log) and removed after it
+// must all come back as they were when the cache is opened again
+func TestSeenCacheRoundTrip(t *testing.T) {
+	cases := []struct {
+		kind      string
+		canRemove bool
+	}{
+		{"map", true},
+		{"hash64", true},
+		{"hash128", true},
+		{"bloom", false},
+	}
+	for _, c := range cases {
+		dir, err := ioutil.TempDir("", "seen")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		ids := seenTestIds(1000)
+		cache, err := NewSeenCache(dir, "test", c.kind, 0.001)
+		if err != nil {
+			t.Fatalf("%s: %s", c.kind, err)
+		}
+		for _, id := range ids[:500] {
+			cache.add(id)
+		}
+		err = cache.snapshot()
+		if err != nil {
+			t.Fatalf("%s: %s", c.kind, err)
+		}
+		for _, id := range ids[500:900] {
+			cache.add(id)
+		}
+		removed := ids[:100]
+		for _, id := range removed {
+			if cache.remove(id) != c.canRemove {
+				t.Fatalf("%s: remove(%s) should return %v", c.kind, id, c.canRemove)
+			}
+		}
+		// like a crash: the log is flushed, but there is no final snapshot
+		cache.flush()
+		// and we were halfway through writing an id
+		cache.logFile.WriteString(ids[950])
+		cache.logFile.Close()
+
+		restored, err := NewSeenCache(dir, "test", c.kind, 0.001)
+		if err != nil {
+			t.Fatalf("%s: %s", c.kind, err)
+		}
+		for i, id := range ids[:900] {
+			want := i >= len(removed) || !c.canRemove
+			if restored.has(id) != want {
+				t.Errorf("%s: after restart, has(%s) is %v, want %v", c.kind, id, !want, want)
+			}
+		}
+		if c.kind != "bloom" {
+			for _, id := range ids[900:] {
+				if restored.has(id) {
+					t.Errorf("%s: after restart, has(%s) for an id we never added", c.kind, id)
+				}
+			}
+		}
+
+		// and once more through the snapshot that close writes
+		restored.close()
+		again, err := NewSeenCache(dir, "test", c.kind, 0.001)
+		if err != nil {
+			t.Fatalf("%s: %s", c.kind, err)
+		}
+		if again.ids.len() != restored.ids.len() {
+			t.Errorf("%s: %d ids after the second restart, want %d", c.kind, again.ids.len(), restored.ids.len())
+		}
+		for _, id := range ids[100:900] {
+			if !again.has(id) {
+				t.Errorf("%s: after the second restart, %s is missing", c.kind, id)
+			}
+		}
+		again.close()
+	}
+}
+
+// a snapshot of a map set can be loaded into any set, the others only into their own kind
+func TestSeenCacheOtherKind(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewSeenCache(dir, "test", "map", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.add("a.b.c")
+	cache.close()
+
+	hashes, err := NewSeenCache(dir, "test", "hash64", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hashes.has("a.b.c") || hashes.ids.len() != 1 {
+		t.Fatal("hash64 set should have loaded the ids of the map snapshot")
+	}
+	hashes.close()
+
+	ids, err := loadSeenIds(dir, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Fatalf("the hash64 snapshot should have replaced the map one, got ids %v", ids)
+	}
+}
+
+// a bloom snapshot for another fp rate is ignored, like one of another kind
+func TestSeenCacheOtherFpRate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewSeenCache(dir, "test", "bloom", 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.add("a.b.c")
+	cache.close()
+
+	tighter, err := NewSeenCache(dir, "test", "bloom", 0.001)
+	if err != nil {
+		t.Fatalf("a snapshot for another fp rate should be ignored, got %s", err)
+	}
+	if tighter.ids.len() != 0 {
+		t.Fatalf("bloom set should have ignored the snapshot for another fp rate, has %d ids", tighter.ids.len())
+	}
+	tighter.add("d.e.f")
+	tighter.close()
+
+	again, err := NewSeenCache(dir, "test", "bloom", 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.has("d.e.f") || again.ids.len() != 1 {
+		t.Fatal("bloom set should have loaded the snapshot for its own fp rate")
+	}
+	again.close()
+}
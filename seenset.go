@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"math"
+)
+
+// the seen sets, selected with elasticsearch.seen_set:
+// map      exact, but holds every id in full.
+// hash64   holds a 64bit hash of every id. two ids with the same hash count as one, so the second one is never
+//          indexed. with n ids, the chance of that is about n/2^64 for every new id.
+// hash128  same with a 128bit hash, which makes collisions practically impossible, at twice the memory of hash64.
+// bloom    a scalable bloom filter: fixed memory per id (a few bytes, depending on elasticsearch.seen_fp_rate)
+//          but new ids are mistaken for seen ones with the given (estimated) false positive rate.
+// memory usage is an estimate of what the set holds, not of what the go runtime allocated for it.
+
+type seenSet interface {
+	has(id string) bool
+	add(id string)         // id must not be in the set yet
+	remove(id string) bool // false if the set can't remove ids
+	len() int
+	memory() int64   // estimated bytes used
+	fpRate() float64 // estimated chance that a new id is reported as seen
+	kind() string    // as configured
+	save(w io.Writer) error
+	load(r *bufio.Reader) error // load what save wrote into an empty set
+}
+
+func newSeenSet(kind string, fpRate float64) (seenSet, error) {
+	switch kind {
+	case "map":
+		return &mapSet{ids: make(map[string]struct{})}, nil
+	case "hash64":
+		return &hash64Set{hashes: make(map[uint64]struct{})}, nil
+	case "hash128":
+		return &hash128Set{hashes: make(map[[2]uint64]struct{}), h: fnv.New128a()}, nil
+	case "bloom":
+		if fpRate <= 0 || fpRate >= 1 {
+			return nil, fmt.Errorf("invalid false positive rate %v, must be between 0 and 1", fpRate)
+		}
+		return newBloomSet(fpRate), nil
+	}
+	return nil, fmt.Errorf("unknown seen set '%s'", kind)
+}
+
+// hash128 returns the fnv-1a 128bit hash of id, as two 64bit halves
+func hash128(h hash.Hash, buf []byte, id string) [2]uint64 {
+	h.Reset()
+	io.WriteString(h, id)
+	sum := h.Sum(buf[:0])
+	return [2]uint64{binary.BigEndian.Uint64(sum), binary.BigEndian.Uint64(sum[8:])}
+}
+
+// fnv64a returns the fnv-1a 64bit hash of id, without allocating
+func fnv64a(id string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(id); i++ {
+		h ^= uint64(id[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// go maps take roughly this many bytes per entry on top of the key and value
+const mapEntryOverhead = 8
+
+type mapSet struct {
+	ids   map[string]struct{}
+	bytes int64 // length of all ids
+}
+
+func (s *mapSet) has(id string) bool {
+	_, ok := s.ids[id]
+	return ok
+}
+
+func (s *mapSet) add(id string) {
+	s.ids[id] = struct{}{}
+	s.bytes += int64(len(id))
+}
+
+func (s *mapSet) remove(id string) bool {
+	if _, ok := s.ids[id]; ok {
+		delete(s.ids, id)
+		s.bytes -= int64(len(id))
+	}
+	return true
+}
+
+func (s *mapSet) len() int {
+	return len(s.ids)
+}
+
+func (s *mapSet) memory() int64 {
+	return s.bytes + int64(len(s.ids))*(16+mapEntryOverhead) // 16 for the string header
+}
+
+func (s *mapSet) fpRate() float64 {
+	return 0
+}
+
+func (s *mapSet) kind() string {
+	return "map"
+}
+
+func (s *mapSet) save(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for id := range s.ids {
+		bw.WriteString(id)
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+func (s *mapSet) load(r *bufio.Reader) error {
+	return readIds(r, s, false)
+}
+
+type hash64Set struct {
+	hashes map[uint64]struct{}
+}
+
+func (s *hash64Set) has(id string) bool {
+	_, ok := s.hashes[fnv64a(id)]
+	return ok
+}
+
+func (s *hash64Set) add(id string) {
+	s.hashes[fnv64a(id)] = struct{}{}
+}
+
+// remove also removes the ids with the same hash
+func (s *hash64Set) remove(id string) bool {
+	delete(s.hashes, fnv64a(id))
+	return true
+}
+
+func (s *hash64Set) len() int {
+	return len(s.hashes)
+}
+
+func (s *hash64Set) memory() int64 {
+	return int64(len(s.hashes)) * (8 + mapEntryOverhead)
+}
+
+func (s *hash64Set) fpRate() float64 {
+	return float64(len(s.hashes)) / math.Pow(2, 64)
+}
+
+func (s *hash64Set) kind() string {
+	return "hash64"
+}
+
+func (s *hash64Set) save(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	buf := make([]byte, 8)
+	for h := range s.hashes {
+		binary.LittleEndian.PutUint64(buf, h)
+		bw.Write(buf)
+	}
+	return bw.Flush()
+}
+
+func (s *hash64Set) load(r *bufio.Reader) error {
+	buf := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s.hashes[binary.LittleEndian.Uint64(buf)] = struct{}{}
+	}
+}
+
+type hash128Set struct {
+	hashes map[[2]uint64]struct{}
+	h      hash.Hash
+	buf    [16]byte
+}
+
+func (s *hash128Set) has(id string) bool {
+	_, ok := s.hashes[hash128(s.h, s.buf[:], id)]
+	return ok
+}
+
+func (s *hash128Set) add(id string) {
+	s.hashes[hash128(s.h, s.buf[:], id)] = struct{}{}
+}
+
+func (s *hash128Set) remove(id string) bool {
+	delete(s.hashes, hash128(s.h, s.buf[:], id))
+	return true
+}
+
+func (s *hash128Set) len() int {
+	return len(s.hashes)
+}
+
+func (s *hash128Set) memory() int64 {
+	return int64(len(s.hashes)) * (16 + mapEntryOverhead)
+}
+
+func (s *hash128Set) fpRate() float64 {
+	return float64(len(s.hashes)) / math.Pow(2, 128)
+}
+
+func (s *hash128Set) kind() string {
+	return "hash128"
+}
+
+func (s *hash128Set) save(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	buf := make([]byte, 16)
+	for h := range s.hashes {
+		binary.LittleEndian.PutUint64(buf, h[0])
+		binary.LittleEndian.PutUint64(buf[8:], h[1])
+		bw.Write(buf)
+	}
+	return bw.Flush()
+}
+
+func (s *hash128Set) load(r *bufio.Reader) error {
+	buf := make([]byte, 16)
+	for {
+		_, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s.hashes[[2]uint64{binary.LittleEndian.Uint64(buf), binary.LittleEndian.Uint64(buf[8:])}] = struct{}{}
+	}
+}
+
+// a scalable bloom filter (Almeida et al, 2007): a series of bloom filters. once the newest one holds
+// as many ids as it was sized for, we add a new one, twice as big and with half the false positive rate,
+// so that the total false positive rate stays below the configured one, however many ids we get.
+
+const (
+	bloomInitialCapacity = 1 << 16
+	bloomGrowth          = 2
+	bloomTightening      = 0.5
+)
+
+type bloomFilter struct {
+	bits     []uint64
+	m        uint64 // number of bits
+	k        uint64 // number of hash functions
+	capacity int
+	count    int
+	set      uint64 // number of bits that are set
+}
+
+func newBloomFilter(capacity int, fpRate float64) *bloomFilter {
+	m, k := bloomSize(capacity, fpRate)
+	return &bloomFilter{bits: make([]uint64, m/64), m: m, k: k, capacity: capacity}
+}
+
+// bloomSize returns the number of bits (a multiple of 64) and hash functions for a filter
+func bloomSize(capacity int, fpRate float64) (m, k uint64) {
+	m = uint64(math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	m = (m + 63) / 64 * 64
+	k = uint64(math.Ceil(float64(m) / float64(capacity) * math.Ln2))
+	return m, k
+}
+
+// fmix64 is murmur3's finalizer, which spreads fnv's hashes of similar ids over all bits
+func fmix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// bloomHash returns the two hashes from which the bit positions for an id are derived, by double hashing
+func bloomHash(id string) [2]uint64 {
+	h := fmix64(fnv64a(id))
+	return [2]uint64{h, fmix64(h) | 1}
+}
+
+func (f *bloomFilter) has(h [2]uint64) bool {
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h[0] + i*h[1]) % f.m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) add(h [2]uint64) {
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h[0] + i*h[1]) % f.m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			f.bits[bit/64] |= 1 << (bit % 64)
+			f.set++
+		}
+	}
+	f.count++
+}
+
+// fpRate is the false positive rate given how full the filter is
+func (f *bloomFilter) fpRate() float64 {
+	return math.Pow(float64(f.set)/float64(f.m), float64(f.k))
+}
+
+type bloomSet struct {
+	filters []*bloomFilter
+	fp      float64 // of the first filter
+	count   int
+}
+
+func newBloomSet(fpRate float64) *bloomSet {
+	fp := fpRate * (1 - bloomTightening)
+	return &bloomSet{
+		filters: []*bloomFilter{newBloomFilter(bloomInitialCapacity, fp)},
+		fp:      fp,
+	}
+}
+
+func (s *bloomSet) has(id string) bool {
+	h := bloomHash(id)
+	for _, f := range s.filters {
+		if f.has(h) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *bloomSet) add(id string) {
+	f := s.filters[len(s.filters)-1]
+	if f.count >= f.capacity {
+		i := len(s.filters)
+		f = newBloomFilter(f.capacity*bloomGrowth, s.fp*math.Pow(bloomTightening, float64(i)))
+		s.filters = append(s.filters, f)
+	}
+	f.add(bloomHash(id))
+	s.count++
+}
+
+// remove can't remove an id from a bloom filter, as its bits are shared with others
+func (s *bloomSet) remove(id string) bool {
+	return false
+}
+
+func (s *bloomSet) len() int {
+	return s.count
+}
+
+func (s *bloomSet) memory() int64 {
+	var bytes int64
+	for _, f := range s.filters {
+		bytes += int64(f.m / 8)
+	}
+	return bytes
+}
+
+func (s *bloomSet) fpRate() float64 {
+	notFp := 1.0
+	for _, f := range s.filters {
+		notFp *= 1 - f.fpRate()
+	}
+	return 1 - notFp
+}
+
+func (s *bloomSet) kind() string {
+	return "bloom"
+}
+
+// save writes the first filter's false positive rate, and for every filter: capacity, count, k and the bits
+func (s *bloomSet) save(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	binary.Write(bw, binary.LittleEndian, math.Float64bits(s.fp))
+	binary.Write(bw, binary.LittleEndian, uint64(len(s.filters)))
+	for _, f := range s.filters {
+		binary.Write(bw, binary.LittleEndian, []uint64{uint64(f.capacity), uint64(f.count), f.k, f.m})
+		binary.Write(bw, binary.LittleEndian, f.bits)
+	}
+	return bw.Flush()
+}
+
+// errBloomFpRate is what load returns for a snapshot of a set with another false positive rate, which we
+// can't continue: its filters are sized for that rate. it's not corrupt, so the caller can just start over.
+var errBloomFpRate = errors.New("bloom filter was saved with a different false positive rate")
+
+func (s *bloomSet) load(r *bufio.Reader) error {
+	var fp, num uint64
+	binary.Read(r, binary.LittleEndian, &fp)
+	err := binary.Read(r, binary.LittleEndian, &num)
+	if err != nil {
+		return err
+	}
+	if math.Float64frombits(fp) != s.fp {
+		return errBloomFpRate
+	}
+	if num == 0 || num > 40 {
+		return fmt.Errorf("invalid bloom filter: %d filters", num)
+	}
+	s.filters = nil
+	s.count = 0
+	capacity := bloomInitialCapacity
+	for i := uint64(0); i < num; i++ {
+		hdr := make([]uint64, 4)
+		err = binary.Read(r, binary.LittleEndian, hdr)
+		if err != nil {
+			return err
+		}
+		// every filter must be sized exactly like add would have made it,
+		// otherwise has and add would index out of the bits, or never match
+		m, k := bloomSize(capacity, s.fp*math.Pow(bloomTightening, float64(i)))
+		if hdr[0] != uint64(capacity) || hdr[1] > hdr[0] || hdr[2] != k || hdr[3] != m || k == 0 || m == 0 {
+			return fmt.Errorf("invalid bloom filter %d: capacity %d, count %d, k %d, m %d", i, hdr[0], hdr[1], hdr[2], hdr[3])
+		}
+		capacity *= bloomGrowth
+		f := &bloomFilter{capacity: int(hdr[0]), count: int(hdr[1]), k: hdr[2], m: hdr[3], bits: make([]uint64, hdr[3]/64)}
+		err = binary.Read(r, binary.LittleEndian, f.bits)
+		if err != nil {
+			return err
+		}
+		for _, word := range f.bits {
+			for ; word != 0; word &= word - 1 {
+				f.set++
+			}
+		}
+		s.filters = append(s.filters, f)
+		s.count += f.count
+	}
+	return nil
+}
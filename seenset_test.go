@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func TestSeenSets(t *testing.T) {
+	ids := seenTestIds(10000)
+	others := seenTestIds(20000)[10000:]
+	for _, kind := range []string{"map", "hash64", "hash128", "bloom"} {
+		set, err := newSeenSet(kind, 0.01)
+		if err != nil {
+			t.Fatalf("%s: %s", kind, err)
+		}
+		for _, id := range ids {
+			set.add(id)
+		}
+		if set.len() != len(ids) {
+			t.Errorf("%s: len is %d, want %d", kind, set.len(), len(ids))
+		}
+		for _, id := range ids {
+			if !set.has(id) {
+				t.Fatalf("%s: lost %s", kind, id)
+			}
+		}
+		fp := 0
+		for _, id := range others {
+			if set.has(id) {
+				fp++
+			}
+		}
+		if kind != "bloom" && fp > 0 {
+			t.Errorf("%s: %d false positives", kind, fp)
+		}
+		if rate := float64(fp) / float64(len(others)); rate > 0.02 {
+			t.Errorf("%s: false positive rate of %v, want at most 0.01", kind, rate)
+		}
+		if set.memory() <= 0 {
+			t.Errorf("%s: memory is %d", kind, set.memory())
+		}
+	}
+	if _, err := newSeenSet("list", 0); err == nil {
+		t.Error("an unknown kind should be rejected")
+	}
+}
+
+func TestBloomSetSaveLoad(t *testing.T) {
+	set := newBloomSet(0.01)
+	// enough ids for a second filter
+	ids := seenTestIds(bloomInitialCapacity + 1000)
+	for _, id := range ids {
+		set.add(id)
+	}
+	if len(set.filters) != 2 {
+		t.Fatalf("expected 2 filters, got %d", len(set.filters))
+	}
+	var buf bytes.Buffer
+	err := set.save(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := newBloomSet(0.01)
+	err = loaded.load(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.len() != set.len() || len(loaded.filters) != 2 {
+		t.Fatalf("loaded %d ids in %d filters, want %d in 2", loaded.len(), len(loaded.filters), set.len())
+	}
+	for _, id := range ids {
+		if !loaded.has(id) {
+			t.Fatalf("loaded set lost %s", id)
+		}
+	}
+	if loaded.fpRate() != set.fpRate() {
+		t.Fatalf("fp rate %v after loading, want %v", loaded.fpRate(), set.fpRate())
+	}
+}
+
+// bloomSnapshot writes what bloomSet.save would, for the given filter headers, with all bits zero
+func bloomSnapshot(fp float64, headers ...[4]uint64) *bufio.Reader {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, math.Float64bits(fp))
+	binary.Write(&buf, binary.LittleEndian, uint64(len(headers)))
+	for _, hdr := range headers {
+		binary.Write(&buf, binary.LittleEndian, hdr[:])
+		binary.Write(&buf, binary.LittleEndian, make([]uint64, hdr[3]/64))
+	}
+	return bufio.NewReader(&buf)
+}
+
+func TestBloomSetLoadInvalid(t *testing.T) {
+	set := newBloomSet(0.01)
+	m, k := bloomSize(bloomInitialCapacity, set.fp)
+	m2, k2 := bloomSize(bloomInitialCapacity*bloomGrowth, set.fp*bloomTightening)
+	capacity := uint64(bloomInitialCapacity)
+
+	valid := bloomSnapshot(set.fp, [4]uint64{capacity, 10, k, m}, [4]uint64{capacity * 2, 0, k2, m2})
+	if err := newBloomSet(0.01).load(valid); err != nil {
+		t.Fatalf("valid snapshot: %s", err)
+	}
+
+	// not corrupt, but not for our fp rate either
+	if err := newBloomSet(0.01).load(bloomSnapshot(set.fp/2, [4]uint64{capacity, 0, k, m})); err != errBloomFpRate {
+		t.Fatalf("other fp rate: got %v, want %v", err, errBloomFpRate)
+	}
+
+	cases := []struct {
+		name string
+		r    *bufio.Reader
+	}{
+		{"no filters", bloomSnapshot(set.fp)},
+		{"k 0", bloomSnapshot(set.fp, [4]uint64{capacity, 0, 0, m})},
+		{"m 0", bloomSnapshot(set.fp, [4]uint64{capacity, 0, k, 0})},
+		{"capacity 0", bloomSnapshot(set.fp, [4]uint64{0, 0, k, m})},
+		{"other capacity", bloomSnapshot(set.fp, [4]uint64{capacity * 2, 0, k, m})},
+		{"other k", bloomSnapshot(set.fp, [4]uint64{capacity, 0, k + 1, m})},
+		{"other m", bloomSnapshot(set.fp, [4]uint64{capacity, 0, k, m + 64})},
+		{"count over capacity", bloomSnapshot(set.fp, [4]uint64{capacity, capacity + 1, k, m})},
+		{"second filter sized like the first", bloomSnapshot(set.fp, [4]uint64{capacity, capacity, k, m}, [4]uint64{capacity, 0, k, m})},
+	}
+	for _, c := range cases {
+		if err := newBloomSet(0.01).load(c.r); err == nil {
+			t.Errorf("%s: load should have failed", c.name)
+		}
+	}
+
+	// truncated bits
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, math.Float64bits(set.fp))
+	binary.Write(&buf, binary.LittleEndian, uint64(1))
+	binary.Write(&buf, binary.LittleEndian, []uint64{capacity, 0, k, m})
+	binary.Write(&buf, binary.LittleEndian, make([]uint64, 3))
+	if err := newBloomSet(0.01).load(bufio.NewReader(&buf)); err == nil {
+		t.Errorf("truncated: load should have failed")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// graceful shutdown. on SIGTERM or SIGINT we stop accepting connections and datagrams, give the open connections
+// a moment to finish what they're sending, and then drain the pipeline stage by stage:
+// parsers, trackers, bulk indexers and forwarders. if that takes longer than shutdown_timeout,
+// we report what didn't make it, and exit anyway.
+
+const shutdownReadGrace = time.Second // how long open connections can keep reading once we shut down
+
+var (
+	drain_started int64 // unix nanoseconds, 0 while running
+
+	closers      []io.Closer // listeners and the udp socket
+	httpServers  []*http.Server
+	servers_lock sync.Mutex
+	acceptors    sync.WaitGroup // accept loops and the udp reader, which start or are producers
+	producers    sync.WaitGroup // connections, which feed lines_read
+	parsers      sync.WaitGroup
+	trackers     sync.WaitGroup
+)
+
+func isDraining() bool {
+	return atomic.LoadInt64(&drain_started) != 0
+}
+
+// drainDeadline is the read deadline for connections once we shut down
+func drainDeadline() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&drain_started)).Add(shutdownReadGrace)
+}
+
+// addCloser registers a listener to be closed when we shut down
+func addCloser(c io.Closer) {
+	closers = append(closers, c)
+}
+
+// serveHTTP runs an http server that is shut down (letting running requests finish) when we shut down
+func serveHTTP(addr string, handler http.Handler) error {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	servers_lock.Lock()
+	httpServers = append(httpServers, srv)
+	servers_lock.Unlock()
+	err := srv.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func shutdown(timeout time.Duration, indexers ...*bulkIndexer) {
+	atomic.StoreInt64(&drain_started, time.Now().UnixNano())
+	for _, c := range closers {
+		c.Close()
+	}
+	interruptConns()
+	done := make(chan struct{})
+	go func() {
+		drain(indexers)
+		close(done)
+	}()
+	select {
+	case <-done:
+		fmt.Println("shutdown complete")
+	case <-time.After(timeout):
+		reportUndrained(timeout, indexers)
+	}
+}
+
+func drain(indexers []*bulkIndexer) {
+	acceptors.Wait()
+	fmt.Printf("shutdown: waiting for %d connections\n", atomic.LoadInt64(&num_conns))
+	servers_lock.Lock()
+	for _, srv := range httpServers {
+		srv.Shutdown(context.Background())
+	}
+	servers_lock.Unlock()
+	producers.Wait()
+	fmt.Println("shutdown: draining parsers")
+	close(lines_read)
+	parsers.Wait()
+	fmt.Println("shutdown: draining trackers")
+	closeTrackers()
+	trackers.Wait()
+	fmt.Println("shutdown: flushing bulk indexers")
+	for _, indexer := range indexers {
+		indexer.Stop()
+	}
+	fmt.Println("shutdown: flushing destinations")
+	for _, dest := range destinations {
+		dest.close()
+	}
+	for _, dest := range destinations {
+		<-dest.done
+	}
+}
+
+// reportUndrained prints what is still in the pipeline, and will be lost
+func reportUndrained(timeout time.Duration, indexers []*bulkIndexer) {
+	fmt.Printf("WARN shutdown deadline of %s hit. dropping what is left:\n", timeout)
+	fmt.Printf("WARN   %d open connections\n", atomic.LoadInt64(&num_conns))
+	fmt.Printf("WARN   %d batches of lines to parse\n", len(lines_read))
+	fmt.Printf("WARN   %d proto1 and %d proto2 metrics to track\n", atomic.LoadInt64(&backlog_proto1), atomic.LoadInt64(&backlog_proto2))
+	for i, indexer := range indexers {
+		fmt.Printf("WARN   %d documents in bulk indexer %d\n", indexer.PendingDocuments(), i+1)
+	}
+	for _, dest := range destinations {
+		fmt.Printf("WARN   %d lines queued for %s\n", len(dest.queue), dest.spec)
+	}
+}
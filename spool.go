@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// a spool is an on-disk FIFO of lines for a destination that can't take them right now.
+// it consists of numbered segment files. we append to the newest one, and roll over to a new
+// segment once it reaches segmentSize. replaying reads from the oldest segment, which gets removed
+// once it has been read entirely.
+// replay progress within a segment is not persisted, so after a restart the oldest segment is replayed
+// from the start. for carbon that's harmless: the same values just get written again.
+
+type spool struct {
+	sync.Mutex
+	dir         string
+	segmentSize int64
+	maxSize     int64
+
+	segments []int // sequence numbers of the segments on disk, oldest first
+	size     int64 // bytes on disk that haven't been replayed yet
+	w        *bufio.Writer
+	wFile    *os.File
+	wSize    int64 // bytes in the current write segment
+	r        *bufio.Reader
+	rFile    *os.File
+	rSeq     int
+
+	bytes    stat
+	numSegs  stat
+	replayed stat
+}
+
+func segmentName(seq int) string {
+	return fmt.Sprintf("%010d.spool", seq)
+}
+
+// NewSpool opens the spool in dir, picking up any segments left behind by a previous run
+func NewSpool(dir string, segmentSize, maxSize int64, key string) (*spool, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	s := &spool{
+		dir:         dir,
+		segmentSize: segmentSize,
+		maxSize:     maxSize,
+		rSeq:        -1,
+		bytes:       NewGauge("unit_is_B.direction_is_out.type_is_spooled.dest_is_"+key, false),
+		numSegs:     NewGauge("unit_is_File.direction_is_out.type_is_spool_segment.dest_is_"+key, false),
+		replayed:    NewCounter("unit_is_Metric.direction_is_out.type_is_replayed.dest_is_"+key, false),
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".spool") {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimSuffix(f.Name(), ".spool"))
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, seq)
+		s.size += f.Size()
+	}
+	sort.Ints(s.segments)
+	if len(s.segments) > 0 {
+		fmt.Printf("spool %s: found %d segments with %d bytes to replay\n", dir, len(s.segments), s.size)
+	}
+	s.updateStats()
+	return s, nil
+}
+
+func (s *spool) updateStats() {
+	s.bytes.Update(s.size)
+	s.numSegs.Update(int64(len(s.segments)))
+}
+
+// Len returns the amount of bytes waiting to be replayed
+func (s *spool) Len() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.size
+}
+
+// Write appends a line to the spool. it returns false if the line could not be spooled
+// because the spool is full or because of an I/O error.
+func (s *spool) Write(buf []byte) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.size+int64(len(buf)) > s.maxSize {
+		return false
+	}
+	if s.w == nil || s.wSize >= s.segmentSize {
+		err := s.roll()
+		if err != nil {
+			fmt.Printf("WARN spool %s: can't create segment: %s\n", s.dir, err.Error())
+			return false
+		}
+	}
+	n, err := s.w.Write(buf)
+	s.wSize += int64(n)
+	s.size += int64(n)
+	s.bytes.Update(s.size)
+	if err != nil {
+		fmt.Printf("WARN spool %s: write failed: %s\n", s.dir, err.Error())
+		return false
+	}
+	return true
+}
+
+// roll closes the current write segment (if any) and starts a new one
+func (s *spool) roll() error {
+	if s.w != nil {
+		s.w.Flush()
+		s.wFile.Close()
+	}
+	seq := 0
+	if len(s.segments) > 0 {
+		seq = s.segments[len(s.segments)-1] + 1
+	}
+	f, err := os.OpenFile(path.Join(s.dir, segmentName(seq)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		s.w = nil
+		s.wFile = nil
+		return err
+	}
+	s.wFile = f
+	s.w = bufio.NewWriter(f)
+	s.wSize = 0
+	s.segments = append(s.segments, seq)
+	s.numSegs.Update(int64(len(s.segments)))
+	return nil
+}
+
+// Read returns up to max lines from the spool, oldest first.
+// fully read segments are removed from disk.
+func (s *spool) Read(max int) [][]byte {
+	s.Lock()
+	defer s.Unlock()
+	lines := make([][]byte, 0, max)
+	for len(lines) < max && len(s.segments) > 0 {
+		seq := s.segments[0]
+		writing := s.w != nil && seq == s.segments[len(s.segments)-1]
+		if writing {
+			s.w.Flush()
+		}
+		if s.r == nil || s.rSeq != seq {
+			f, err := os.Open(path.Join(s.dir, segmentName(seq)))
+			if err != nil {
+				fmt.Printf("WARN spool %s: can't open segment %d: %s. skipping it\n", s.dir, seq, err.Error())
+				s.removeOldest(0)
+				continue
+			}
+			s.rFile = f
+			s.r = bufio.NewReader(f)
+			s.rSeq = seq
+		}
+		buf, err := s.r.ReadBytes('\n')
+		if err == nil {
+			s.size -= int64(len(buf))
+			lines = append(lines, buf)
+			continue
+		}
+		if err == io.EOF && writing {
+			// caught up with the writer. whatever partial line we got will be read again later.
+			if len(buf) > 0 {
+				s.rFile.Seek(-int64(len(buf)), io.SeekCurrent)
+				s.r.Reset(s.rFile)
+			}
+			break
+		}
+		if err != io.EOF {
+			fmt.Printf("WARN spool %s: can't read segment %d: %s. skipping rest of it\n", s.dir, seq, err.Error())
+		}
+		s.removeOldest(int64(len(buf)))
+	}
+	if s.size == 0 && len(s.segments) > 0 {
+		// everything has been replayed. get rid of the segments, so that they won't be replayed
+		// again after a restart
+		if s.w != nil {
+			s.wFile.Close()
+			s.w = nil
+			s.wFile = nil
+		}
+		for len(s.segments) > 0 {
+			s.removeOldest(0)
+		}
+	}
+	s.replayed.Inc(int64(len(lines)))
+	s.updateStats()
+	return lines
+}
+
+// removeOldest closes and deletes the oldest segment. unread is the amount of bytes
+// in it that are being discarded without having been replayed.
+func (s *spool) removeOldest(unread int64) {
+	seq := s.segments[0]
+	if s.rFile != nil && s.rSeq == seq {
+		s.rFile.Close()
+		s.rFile = nil
+		s.r = nil
+		s.rSeq = -1
+	}
+	os.Remove(path.Join(s.dir, segmentName(seq)))
+	s.segments = s.segments[1:]
+	s.size -= unread
+	if len(s.segments) == 0 {
+		s.size = 0
+	}
+}
+
+// Close writes out what's buffered and closes the segment files. the segments stay on disk for the next run.
+func (s *spool) Close() {
+	s.Lock()
+	defer s.Unlock()
+	if s.w != nil {
+		err := s.w.Flush()
+		if err != nil {
+			fmt.Printf("WARN spool %s: write failed: %s\n", s.dir, err.Error())
+		}
+		s.wFile.Close()
+		s.w = nil
+		s.wFile = nil
+	}
+	if s.rFile != nil {
+		s.rFile.Close()
+		s.rFile = nil
+		s.r = nil
+		s.rSeq = -1
+	}
+}
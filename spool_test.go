@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func spoolTestLines(from, to int) []string {
+	var lines []string
+	for i := from; i < to; i++ {
+		lines = append(lines, fmt.Sprintf("some.metric.%d %d 1700000000\n", i, i))
+	}
+	return lines
+}
+
+func readSpool(s *spool, max int) []string {
+	var lines []string
+	for _, line := range s.Read(max) {
+		lines = append(lines, string(line))
+	}
+	return lines
+}
+
+func equalLines(t *testing.T, what string, got, want []string) {
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %d lines, want %d", what, len(got), len(want))
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("%s: line %d is %q, want %q", what, i, got[i], want[i])
+		}
+	}
+}
+
+func TestSpoolReplayAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// segments of about 10 lines
+	s, err := NewSpool(dir, 300, 1<<20, "test_restart_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := spoolTestLines(0, 100)
+	var size int64
+	for _, line := range lines {
+		if !s.Write([]byte(line)) {
+			t.Fatalf("can't spool %q", line)
+		}
+		size += int64(len(line))
+	}
+	if len(s.segments) < 5 {
+		t.Fatalf("expected the spool to roll over a few times, it has %d segments", len(s.segments))
+	}
+	s.Close()
+
+	s, err = NewSpool(dir, 300, 1<<20, "test_restart_2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != size {
+		t.Fatalf("%d bytes to replay after restart, want %d", s.Len(), size)
+	}
+	// lines spooled after the restart come after the old ones
+	more := spoolTestLines(100, 110)
+	for _, line := range more {
+		s.Write([]byte(line))
+	}
+	var got []string
+	for {
+		batch := readSpool(s, 7)
+		if len(batch) == 0 {
+			break
+		}
+		got = append(got, batch...)
+	}
+	equalLines(t, "replay", got, append(lines, more...))
+	if s.Len() != 0 || len(s.segments) != 0 {
+		t.Fatalf("spool should be empty, has %d bytes in %d segments", s.Len(), len(s.segments))
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Fatalf("replayed segments should be removed, found %d files", len(files))
+	}
+	s.Close()
+}
+
+// a segment that was partially replayed before a restart is replayed again from its start
+func TestSpoolPartialReplayAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewSpool(dir, 300, 1<<20, "test_partial_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := spoolTestLines(0, 50)
+	for _, line := range lines {
+		s.Write([]byte(line))
+	}
+	// a segment rolls over once it has 300 bytes or more
+	perSegment, segSize := 0, 0
+	for segSize < 300 {
+		segSize += len(lines[perSegment])
+		perSegment++
+	}
+	// all of the first segment, and 3 lines of the second
+	equalLines(t, "first read", readSpool(s, perSegment+3), lines[:perSegment+3])
+	s.Close()
+
+	s, err = NewSpool(dir, 300, 1<<20, "test_partial_2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	equalLines(t, "replay", readSpool(s, 1000), lines[perSegment:])
+	s.Close()
+}
+
+// reading catches up with the segment that is being written, and picks up what's written after that
+func TestSpoolReadWhileWriting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewSpool(dir, 1<<20, 1<<20, "test_interleaved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := spoolTestLines(0, 20)
+	var got []string
+	for i, line := range lines {
+		s.Write([]byte(line))
+		if i%3 == 0 {
+			got = append(got, readSpool(s, 100)...)
+		}
+	}
+	got = append(got, readSpool(s, 100)...)
+	equalLines(t, "interleaved", got, lines)
+	s.Close()
+}
+
+func TestSpoolFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	line := []byte(spoolTestLines(0, 1)[0])
+	max := int64(len(line) * 5)
+	s, err := NewSpool(dir, 1<<20, max, "test_full")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if !s.Write(line) {
+			t.Fatalf("write %d should fit", i)
+		}
+	}
+	if s.Write(line) {
+		t.Fatal("write beyond the maximum size should fail")
+	}
+	readSpool(s, 2)
+	if !s.Write(line) {
+		t.Fatal("write should fit again after replaying")
+	}
+	s.Close()
+}
@@ -14,12 +14,14 @@ import (
 // and we set the metrics 2.0 type via constructor methods
 
 // also, this type optionally allows you to hook in a custom value generator to respond to Value() requests on the fly via
-// a request/response channel (it is important that calling code handles these requests promptly!)
+// a request/response channel (it is important that calling code handles these requests promptly!),
+// or, for values that are safe to read from any goroutine, a function that returns the value.
 
 type stat struct {
 	val       metrics.Counter
 	valueReq  chan bool
 	valueResp chan int64
+	value     func() int64
 }
 
 func NewCounter(key string, customValue bool) stat {
@@ -49,11 +51,25 @@ func NewGauge(key string, customValue bool) stat {
 	return s
 }
 
+// NewFuncGauge returns a gauge whose value is whatever value returns at the time it's reported
+func NewFuncGauge(key string, value func() int64) stat {
+	name := fmt.Sprintf("service_is_carbon-tagger.instance_is_%s.target_type_is_gauge.%s", *stats_id, key)
+	s := stat{val: metrics.NewCounter(), value: value}
+	err := metrics.Register(name, &s)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
 func (s *stat) Clear() {
 	s.val.Clear()
 }
 
 func (s *stat) Count() int64 {
+	if s.value != nil {
+		s.Update(s.value())
+	}
 	if s.valueReq != nil {
 		s.valueReq <- true
 		val := <-s.valueResp
@@ -78,3 +94,14 @@ func (s *stat) Update(v int64) {
 	s.val.Clear()
 	s.val.Inc(v)
 }
+
+// NewFloatGauge returns a plain go-metrics gauge, for the few stats that aren't integers
+func NewFloatGauge(key string) metrics.GaugeFloat64 {
+	name := fmt.Sprintf("service_is_carbon-tagger.instance_is_%s.target_type_is_gauge.%s", *stats_id, key)
+	g := metrics.NewGaugeFloat64()
+	err := metrics.Register(name, g)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	m20 "github.com/metrics20/go-metrics20"
+	"sort"
+	"strings"
+)
+
+// support for graphite's (carbon 1.1+) tagged series: name;tag1=value1;tag2=value2
+// they become metrics with the name as "name" tag, plus the given tags.
+// like carbon, we normalize the id by sorting the tags, so that the same series always gets the same id,
+// regardless of the order in which the tags were sent. the line itself is forwarded unaltered.
+
+func isTaggedSeries(id string) bool {
+	return strings.Contains(id, ";")
+}
+
+// parseTaggedSeries validates a tagged series the way carbon does, and returns it as a metric with
+// the normalized id. if requireUnit is set, it is also held to the proto2 requirements: a unit tag
+// and at least one other tag (which is always satisfied by the name).
+func parseTaggedSeries(id string, requireUnit bool) (*m20.MetricSpec, error) {
+	parts := strings.Split(id, ";")
+	name := parts[0]
+	if name == "" {
+		return nil, fmt.Errorf("tagged series '%s' has an empty name", id)
+	}
+	tags := map[string]string{"name": name}
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("tagged series '%s' has an invalid tag '%s'", id, part)
+		}
+		key, val := kv[0], kv[1]
+		if strings.ContainsAny(key, "!^=") {
+			return nil, fmt.Errorf("tagged series '%s' has an invalid tag key '%s'", id, key)
+		}
+		if strings.HasPrefix(val, "~") {
+			return nil, fmt.Errorf("tagged series '%s' has an invalid tag value '%s'", id, val)
+		}
+		if key == "name" {
+			return nil, fmt.Errorf("tagged series '%s' can't have a 'name' tag", id)
+		}
+		tags[key] = val
+	}
+	if requireUnit {
+		if _, ok := tags["unit"]; !ok {
+			return nil, errors.New("tagged series must have a unit tag: " + id)
+		}
+	}
+	keys := make([]string, 0, len(tags)-1)
+	for key := range tags {
+		if key != "name" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	normalized := name
+	for _, key := range keys {
+		normalized += ";" + key + "=" + tags[key]
+	}
+	return &m20.MetricSpec{Id: normalized, Tags: tags}, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseTaggedSeries(t *testing.T) {
+	cases := []struct {
+		id   string
+		norm string
+		tags map[string]string
+	}{
+		{"disk.used;host=db1", "disk.used;host=db1", map[string]string{"name": "disk.used", "host": "db1"}},
+		// tags are sorted, so that the same series always gets the same id
+		{"disk.used;unit=B;host=db1", "disk.used;host=db1;unit=B", map[string]string{"name": "disk.used", "host": "db1", "unit": "B"}},
+		{"cpu;a=b=c", "cpu;a=b=c", map[string]string{"name": "cpu", "a": "b=c"}},
+	}
+	for _, c := range cases {
+		if !isTaggedSeries(c.id) {
+			t.Errorf("%s should be a tagged series", c.id)
+		}
+		metric, err := parseTaggedSeries(c.id, false)
+		if err != nil {
+			t.Errorf("%s: %s", c.id, err)
+			continue
+		}
+		if metric.Id != c.norm {
+			t.Errorf("%s is normalized to %s, want %s", c.id, metric.Id, c.norm)
+		}
+		if len(metric.Tags) != len(c.tags) {
+			t.Errorf("%s has tags %v, want %v", c.id, metric.Tags, c.tags)
+			continue
+		}
+		for k, v := range c.tags {
+			if metric.Tags[k] != v {
+				t.Errorf("%s has tags %v, want %v", c.id, metric.Tags, c.tags)
+				break
+			}
+		}
+	}
+	if isTaggedSeries("a.b.c") || isTaggedSeries("unit_is_B.what_is_mem") {
+		t.Error("plain ids are no tagged series")
+	}
+}
+
+func TestParseTaggedSeriesInvalid(t *testing.T) {
+	for _, id := range []string{
+		";host=db1",
+		"cpu;host",
+		"cpu;host=",
+		"cpu;=db1",
+		"cpu;ho!st=db1",
+		"cpu;host=~db1",
+		"cpu;name=other",
+	} {
+		if _, err := parseTaggedSeries(id, false); err == nil {
+			t.Errorf("%s should be rejected", id)
+		}
+	}
+	if _, err := parseTaggedSeries("cpu;host=db1", true); err == nil {
+		t.Error("without unit tag, cpu;host=db1 should be rejected when a unit is required")
+	}
+	if _, err := parseTaggedSeries("cpu;host=db1;unit=Pct", true); err != nil {
+		t.Errorf("with unit tag, cpu;host=db1;unit=Pct should be accepted: %s", err)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	m20 "github.com/metrics20/go-metrics20"
+	"github.com/vimeo/carbon-tagger/_third_party/github.com/Dieterbe/go-metrics"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the trackers submit the metrics they haven't seen before to ES. per protocol, there are elasticsearch.trackers
+// of them, and metrics are sharded over them by a hash of their id, so every tracker owns its slice of the seen set,
+// and a slow indexer call only holds up one shard. the trackers don't answer stats requests themselves:
+// they keep their numbers in atomics, which serveTrackerStats aggregates.
+
+type trackerShard struct {
+	recent      int64 // ids seen since the stats were last read. atomic
+	resetRecent int32 // set by the stats reader, to have the shard start counting anew. atomic
+
+	seen   *seenCache
+	proto1 chan []string         // only for proto1 trackers
+	proto2 chan []m20.MetricSpec // only for proto2 trackers
+	warm   chan []string
+	dump   chan chan []string // to ask for the ids in the seen cache
+	done   chan struct{}      // closed when the tracker returns, so the above aren't answered anymore
+
+	forgetLock sync.Mutex
+	forgotten  []string // ids the bulk indexer gave up on, to remove from the seen cache
+}
+
+var proto1_shards, proto2_shards []*trackerShard
+
+// tracker stats that are aggregated over the shards of a protocol
+type trackerStats struct {
+	memory stat
+	fpRate metrics.GaugeFloat64
+}
+
+var trackerStats1, trackerStats2 trackerStats
+
+// shardFor returns the shard for a metric id
+func shardFor(id string, n int) int {
+	return int(fnv64a(id) % uint64(n))
+}
+
+// shardName returns the name of shard i of n for a protocol, which names its seen cache files
+func shardName(proto, i, n int) string {
+	// a single tracker keeps the names from before trackers were sharded
+	if n == 1 {
+		return fmt.Sprintf("proto%d", proto)
+	}
+	return fmt.Sprintf("proto%d.%dof%d", proto, i+1, n)
+}
+
+// newTrackerShards creates the shards for a protocol, loading their seen caches, and registers its stats.
+// every shard's channel holds up to backlog metrics, in batches of batchSize.
+func newTrackerShards(proto, n, backlog, batchSize int) ([]*trackerShard, trackerStats, error) {
+	var shards []*trackerShard
+	restored := NewGauge(fmt.Sprintf("unit_is_Metric.proto_is_%d.type_is_restored_seen", proto), false)
+	loadTime := NewGauge(fmt.Sprintf("unit_is_ms.proto_is_%d.type_is_seen_load_duration", proto), false)
+	stats := trackerStats{
+		memory: NewGauge(fmt.Sprintf("unit_is_B.proto_is_%d.type_is_seen_set_memory", proto), false),
+		fpRate: NewFloatGauge(fmt.Sprintf("unit_is_Pct.proto_is_%d.type_is_seen_set_false_positive_rate", proto)),
+	}
+	batches := backlog / n / batchSize
+	if batches < 1 {
+		batches = 1
+	}
+	total, dur := 0, time.Duration(0)
+	for i := 0; i < n; i++ {
+		seen, err := NewSeenCache(*es_cache_dir, shardName(proto, i, n), *es_seen_set, *es_seen_fp_rate)
+		if err != nil {
+			return nil, stats, err
+		}
+		total += seen.restored
+		dur += seen.loadTime
+		shard := &trackerShard{seen: seen, warm: make(chan []string), dump: make(chan chan []string), done: make(chan struct{})}
+		if proto == 1 {
+			shard.proto1 = make(chan []string, batches)
+		} else {
+			shard.proto2 = make(chan []m20.MetricSpec, batches)
+		}
+		shards = append(shards, shard)
+	}
+	if *es_cache_dir != "" {
+		restored.Update(int64(total))
+		loadTime.Update(int64(dur / time.Millisecond))
+		fmt.Printf("seen caches proto%d: restored %d ids in %s\n", proto, total, dur)
+	}
+	return shards, stats, nil
+}
+
+// submitProto1 hands a batch of proto1 ids to the trackers
+func submitProto1(batch []string) {
+	atomic.AddInt64(&backlog_proto1, int64(len(batch)))
+	n := len(proto1_shards)
+	if n == 1 {
+		proto1_shards[0].proto1 <- batch
+		return
+	}
+	parts := make([][]string, n)
+	for _, id := range batch {
+		i := shardFor(id, n)
+		parts[i] = append(parts[i], id)
+	}
+	for i, part := range parts {
+		if len(part) > 0 {
+			proto1_shards[i].proto1 <- part
+		}
+	}
+}
+
+// submitProto2 hands a batch of proto2 metrics to the trackers
+func submitProto2(batch []m20.MetricSpec) {
+	atomic.AddInt64(&backlog_proto2, int64(len(batch)))
+	n := len(proto2_shards)
+	if n == 1 {
+		proto2_shards[0].proto2 <- batch
+		return
+	}
+	parts := make([][]m20.MetricSpec, n)
+	for _, metric := range batch {
+		i := shardFor(metric.Id, n)
+		parts[i] = append(parts[i], metric)
+	}
+	for i, part := range parts {
+		if len(part) > 0 {
+			proto2_shards[i].proto2 <- part
+		}
+	}
+}
+
+// warmShards hands ids that are known to be in ES to the trackers they belong to.
+// it returns false if the trackers have returned, as we're shutting down.
+func warmShards(shards []*trackerShard, ids []string) bool {
+	n := len(shards)
+	parts := make([][]string, n)
+	for _, id := range ids {
+		i := shardFor(id, n)
+		parts[i] = append(parts[i], id)
+	}
+	for i, part := range parts {
+		if len(part) == 0 {
+			continue
+		}
+		select {
+		case shards[i].warm <- part:
+		case <-shards[i].done:
+			return false
+		}
+	}
+	return true
+}
+
+// forgetShards has the trackers remove ids from their seen caches, before they process their next batch.
+// the bulk indexers call it, so it must not block on the trackers, which may be waiting for the indexer.
+func forgetShards(shards []*trackerShard, ids []string) {
+	if len(shards) == 0 {
+		return // we're not tracking, but reconciling
+	}
+	for _, id := range ids {
+		shard := shards[shardFor(id, len(shards))]
+		shard.forgetLock.Lock()
+		shard.forgotten = append(shard.forgotten, id)
+		shard.forgetLock.Unlock()
+	}
+}
+
+// closeTrackers makes the trackers return once they've processed what they have
+func closeTrackers() {
+	for _, shard := range proto1_shards {
+		close(shard.proto1)
+	}
+	for _, shard := range proto2_shards {
+		close(shard.proto2)
+	}
+}
+
+// snapshotTicker returns the channel on which trackers are told to snapshot their seen cache, if it's persisted
+func snapshotTicker() <-chan time.Time {
+	if *es_cache_dir == "" {
+		return nil
+	}
+	return time.NewTicker(time.Duration(*es_cache_snap) * time.Second).C
+}
+
+// newRecentSet returns a set like the seen caches use, for the ids seen in a stats interval
+func newRecentSet() seenSet {
+	set, _ := newSeenSet(*es_seen_set, *es_seen_fp_rate) // the seen caches made sure this works
+	return set
+}
+
+// recentSet returns the set for the ids seen in the current stats interval, which is a new one if the stats were read
+func (s *trackerShard) recentSet(seenStats seenSet) seenSet {
+	if atomic.SwapInt32(&s.resetRecent, 0) == 1 {
+		return newRecentSet()
+	}
+	return seenStats
+}
+
+// warmed adds ids that are known to be in ES to the seen cache
+func (s *trackerShard) warmed(ids []string) {
+	for _, id := range ids {
+		if !s.seen.has(id) {
+			s.seen.add(id)
+		}
+	}
+	s.seen.flush()
+}
+
+// forget removes the ids the bulk indexer gave up on from the seen cache, so they're submitted again
+func (s *trackerShard) forget() {
+	s.forgetLock.Lock()
+	ids := s.forgotten
+	s.forgotten = nil
+	s.forgetLock.Unlock()
+	for _, id := range ids {
+		s.seen.remove(id)
+	}
+}
+
+func (s *trackerShard) snapshot() {
+	err := s.seen.snapshot()
+	if err != nil {
+		fmt.Printf("WARN %s\n", err.Error())
+	}
+}
+
+func trackProto1(shard *trackerShard, indexer *bulkIndexer) {
+	defer trackers.Done()
+	defer close(shard.done)
+	snapshotTick := snapshotTicker()
+	seenEs := shard.seen        // for ES. seen once = never need to resubmit
+	seenStats := newRecentSet() // for stats, provides "how many recently seen?"
+	for {
+		select {
+		case batch, ok := <-shard.proto1:
+			if !ok {
+				seenEs.close()
+				return
+			}
+			atomic.AddInt64(&backlog_proto1, -int64(len(batch)))
+			shard.forget()
+			seenStats = shard.recentSet(seenStats)
+			recent := int64(0)
+			for _, str := range batch {
+				if !seenStats.has(str) {
+					seenStats.add(str)
+					recent++
+				}
+				if seenEs.has(str) {
+					continue
+				}
+				err := indexer.Index(str, nil)
+				dieIfError(err)
+				seenEs.add(str)
+			}
+			atomic.AddInt64(&shard.recent, recent)
+			seenEs.flush()
+		case ids := <-shard.warm:
+			shard.warmed(ids)
+		case resp := <-shard.dump:
+			ids, _ := shard.seen.list()
+			resp <- ids
+		case <-snapshotTick:
+			shard.snapshot()
+		}
+	}
+}
+
+func trackProto2(shard *trackerShard, indexer *bulkIndexer) {
+	defer trackers.Done()
+	defer close(shard.done)
+	snapshotTick := snapshotTicker()
+	seenEs := shard.seen        // for ES. seen once = never need to resubmit
+	seenStats := newRecentSet() // for stats, provides "how many recently seen?"
+	for {
+		select {
+		case batch, ok := <-shard.proto2:
+			if !ok {
+				seenEs.close()
+				return
+			}
+			atomic.AddInt64(&backlog_proto2, -int64(len(batch)))
+			shard.forget()
+			seenStats = shard.recentSet(seenStats)
+			recent := int64(0)
+			for _, metric := range batch {
+				if !seenStats.has(metric.Id) {
+					seenStats.add(metric.Id)
+					recent++
+				}
+				if seenEs.has(metric.Id) {
+					continue
+				}
+				err := indexer.Index(metric.Id, &metric)
+				dieIfError(err)
+				seenEs.add(metric.Id)
+			}
+			atomic.AddInt64(&shard.recent, recent)
+			seenEs.flush()
+		case ids := <-shard.warm:
+			shard.warmed(ids)
+		case resp := <-shard.dump:
+			ids, _ := shard.seen.list()
+			resp <- ids
+		case <-snapshotTick:
+			shard.snapshot()
+		}
+	}
+}
+
+// readRecent returns how many ids the shards have seen since the last call, and has them start counting anew.
+// ids that come in while we read may be counted again in the next interval.
+func readRecent(shards []*trackerShard) int64 {
+	total := int64(0)
+	for _, shard := range shards {
+		total += atomic.SwapInt64(&shard.recent, 0)
+		atomic.StoreInt32(&shard.resetRecent, 1)
+	}
+	return total
+}
+
+// update sets the seen set stats from what the shards report
+func (t trackerStats) update(shards []*trackerShard) {
+	memory := int64(0)
+	fpRate := 0.0
+	for _, shard := range shards {
+		memory += atomic.LoadInt64(&shard.seen.memory)
+		fpRate += math.Float64frombits(atomic.LoadUint64(&shard.seen.fpRate))
+	}
+	t.memory.Update(memory)
+	// a new id goes to one of the shards, so the chance it's a false positive is the average over them
+	t.fpRate.Update(fpRate / float64(len(shards)) * 100)
+}
+
+// serveTrackerStats answers the value requests for the tracker stats, so the trackers never have to.
+func serveTrackerStats(indexer1, indexer2 *bulkIndexer) {
+	tick := time.NewTicker(time.Second)
+	for {
+		select {
+		case <-tick.C:
+			trackerStats1.update(proto1_shards)
+			trackerStats2.update(proto2_shards)
+		case <-num_seen_proto1.valueReq:
+			num_seen_proto1.valueResp <- readRecent(proto1_shards)
+		case <-num_seen_proto2.valueReq:
+			num_seen_proto2.valueResp <- readRecent(proto2_shards)
+		case <-pending_backlog_proto1.valueReq:
+			pending_backlog_proto1.valueResp <- atomic.LoadInt64(&backlog_proto1)
+		case <-pending_backlog_proto2.valueReq:
+			pending_backlog_proto2.valueResp <- atomic.LoadInt64(&backlog_proto2)
+		case <-pending_es_proto1.valueReq:
+			pending_es_proto1.valueResp <- int64(indexer1.PendingDocuments())
+		case <-pending_es_proto2.valueReq:
+			pending_es_proto2.valueResp <- int64(indexer2.PendingDocuments())
+		}
+	}
+}
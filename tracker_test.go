@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	m20 "github.com/metrics20/go-metrics20"
+	"testing"
+)
+
+const benchBatchSize = 100
+
+// benchIndexer is a bulk indexer that builds the documents, like the real one, but drops them instead of sending them
+func benchIndexer(proto int) *bulkIndexer {
+	b := &bulkIndexer{index: "bench", policy: "create", schema: "flat", proto: proto, docs: make(chan bulkDoc, 1000)}
+	go func() {
+		for range b.docs {
+		}
+	}()
+	return b
+}
+
+// benchShards creates n tracker shards for a protocol, like newTrackerShards, but without registering stats
+func benchShards(proto, n int) []*trackerShard {
+	var shards []*trackerShard
+	for i := 0; i < n; i++ {
+		seen, _ := NewSeenCache("", shardName(proto, i, n), "map", 0)
+		shard := &trackerShard{seen: seen, warm: make(chan []string), dump: make(chan chan []string), done: make(chan struct{})}
+		if proto == 1 {
+			shard.proto1 = make(chan []string, 100)
+		} else {
+			shard.proto2 = make(chan []m20.MetricSpec, 100)
+		}
+		shards = append(shards, shard)
+	}
+	return shards
+}
+
+// every op is a batch of benchBatchSize new ids, which all get indexed
+func benchmarkTrackProto1(b *testing.B, n int) {
+	batches := make([][]string, b.N)
+	for i := range batches {
+		for j := 0; j < benchBatchSize; j++ {
+			batches[i] = append(batches[i], fmt.Sprintf("servers.web%d.cpu.cpu%d.user", i, j))
+		}
+	}
+	defer func(orig []*trackerShard) { proto1_shards = orig }(proto1_shards)
+	proto1_shards = benchShards(1, n)
+	indexer := benchIndexer(1)
+	trackers.Add(n)
+	for _, shard := range proto1_shards {
+		go trackProto1(shard, indexer)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for _, batch := range batches {
+		submitProto1(batch)
+	}
+	for _, shard := range proto1_shards {
+		close(shard.proto1)
+	}
+	trackers.Wait()
+	b.StopTimer()
+	close(indexer.docs)
+}
+
+func benchmarkTrackProto2(b *testing.B, n int) {
+	batches := make([][]m20.MetricSpec, b.N)
+	for i := range batches {
+		for j := 0; j < benchBatchSize; j++ {
+			metric, err := m20.NewMetricSpec(fmt.Sprintf("unit_is_B.what_is_mem.server_is_web%d.core_is_%d", i, j))
+			if err != nil {
+				b.Fatal(err)
+			}
+			batches[i] = append(batches[i], *metric)
+		}
+	}
+	defer func(orig []*trackerShard) { proto2_shards = orig }(proto2_shards)
+	proto2_shards = benchShards(2, n)
+	indexer := benchIndexer(2)
+	trackers.Add(n)
+	for _, shard := range proto2_shards {
+		go trackProto2(shard, indexer)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for _, batch := range batches {
+		submitProto2(batch)
+	}
+	for _, shard := range proto2_shards {
+		close(shard.proto2)
+	}
+	trackers.Wait()
+	b.StopTimer()
+	close(indexer.docs)
+}
+
+func BenchmarkTrackProto1Shards1(b *testing.B) { benchmarkTrackProto1(b, 1) }
+func BenchmarkTrackProto1Shards2(b *testing.B) { benchmarkTrackProto1(b, 2) }
+func BenchmarkTrackProto1Shards4(b *testing.B) { benchmarkTrackProto1(b, 4) }
+func BenchmarkTrackProto1Shards8(b *testing.B) { benchmarkTrackProto1(b, 8) }
+func BenchmarkTrackProto2Shards1(b *testing.B) { benchmarkTrackProto2(b, 1) }
+func BenchmarkTrackProto2Shards2(b *testing.B) { benchmarkTrackProto2(b, 2) }
+func BenchmarkTrackProto2Shards4(b *testing.B) { benchmarkTrackProto2(b, 4) }
+func BenchmarkTrackProto2Shards8(b *testing.B) { benchmarkTrackProto2(b, 8) }
+
+// every id goes to the shard that owns it, in the order it came in
+func TestSubmitProto1Shards(t *testing.T) {
+	defer func(orig []*trackerShard) { proto1_shards = orig }(proto1_shards)
+	proto1_shards = benchShards(1, 4)
+	var batch []string
+	for i := 0; i < 50; i++ {
+		batch = append(batch, fmt.Sprintf("a.b%d", i))
+	}
+	submitProto1(batch)
+	got := 0
+	for i, shard := range proto1_shards {
+		if len(shard.proto1) == 0 {
+			continue
+		}
+		prev := -1
+		for _, id := range <-shard.proto1 {
+			if shardFor(id, 4) != i {
+				t.Errorf("%s went to shard %d", id, i)
+			}
+			var n int
+			fmt.Sscanf(id, "a.b%d", &n)
+			if n <= prev {
+				t.Errorf("%s came after a.b%d", id, prev)
+			}
+			prev = n
+			got++
+		}
+	}
+	if got != len(batch) {
+		t.Fatalf("shards got %d ids, want %d", got, len(batch))
+	}
+	backlog_proto1 = 0
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// handleUDP reads datagrams, each holding one or more newline separated lines, and feeds the lines
+// into the same pipeline as the tcp listener.
+// datagrams that don't fit in the buffer are truncated by the kernel, in which case we drop the
+// last (partial) line.
+// every datagram that we can't take entirely is counted once: as truncated if it was, otherwise as bad
+// (a read error or no lines), so a truncated datagram without a single complete line is only counted as truncated.
+func handleUDP(conn *net.UDPConn, bufSize int) {
+	buf := make([]byte, bufSize)
+	batch := newLineBatcher(*in_batch_size, *in_udp_tok == "lenient")
+	defer acceptors.Done()
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if isDraining() {
+				return
+			}
+			fmt.Printf("WARN udp read failed: %s\n", err.Error())
+			in_udp_bad_total.Inc(1)
+			continue
+		}
+		in_udp_packets_total.Inc(1)
+		data := buf[:n]
+		if n == bufSize {
+			in_udp_truncated_total.Inc(1)
+			i := bytes.LastIndexByte(data, '\n')
+			if isVerbose() {
+				fmt.Printf("udp packet truncated at %d bytes, dropping last line: '%s'\n", n, data[i+1:])
+			}
+			data = data[:i+1]
+		}
+		if len(bytes.TrimSpace(data)) == 0 {
+			if n < bufSize {
+				in_udp_bad_total.Inc(1)
+			}
+			continue
+		}
+		for len(data) > 0 {
+			i := bytes.IndexByte(data, '\n')
+			var line []byte
+			if i == -1 {
+				// the last line need not be terminated. we make sure all lines we pass on are.
+				line = append(data[:len(data):len(data)], '\n')
+				data = nil
+			} else {
+				line = data[:i+1]
+				data = data[i+1:]
+			}
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			batch.add(line)
+		}
+		batch.flush()
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDP(t *testing.T) {
+	defer func(orig chan [][]byte) { lines_read = orig }(lines_read)
+	lines_read = make(chan [][]byte, 100)
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go handleUDP(conn, 40)
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	truncated, bad := in_udp_truncated_total.Count(), in_udp_bad_total.Count()
+	datagrams := []string{
+		"a.b 1 1434000000\nc.d 2 1434000000\n",
+		// the last line needn't be terminated
+		"e.f 3 1434000000",
+		" \n",
+		// truncated: the partial line is dropped
+		"g.h 4 1434000000\ni.j 5 1434000000\nk.l 6 1434000000\n",
+		// truncated without a complete line: only counted as truncated
+		"o.p.q.r.s.t.u.v.w.x.y.z.a.b.c.d.e.f.g.h 8 1434000000\n",
+		"m.n 7 1434000000\n",
+	}
+	want := []string{
+		"a.b 1 1434000000\n",
+		"c.d 2 1434000000\n",
+		"e.f 3 1434000000\n",
+		"g.h 4 1434000000\n",
+		"i.j 5 1434000000\n",
+		"m.n 7 1434000000\n",
+	}
+	for _, d := range datagrams {
+		if _, err := client.Write([]byte(d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got [][]byte
+	for len(got) < len(want) {
+		select {
+		case batch := <-lines_read:
+			got = append(got, batch...)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after %d lines", len(got))
+		}
+	}
+	for i, line := range want {
+		if string(got[i]) != line {
+			t.Errorf("line %d is %q, want %q", i, got[i], line)
+		}
+	}
+	if n := in_udp_truncated_total.Count() - truncated; n != 2 {
+		t.Errorf("%d truncated packets counted, want 2", n)
+	}
+	if n := in_udp_bad_total.Count() - bad; n != 1 {
+		t.Errorf("%d bad packets counted, want 1", n)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// validation of the value and timestamp of a line.
+// values must be floats. NaN and +/-Inf are dropped or passed on, based on in.nonfinite_values.
+// timestamps are seconds, and may have a fractional part, which we ignore, like carbon does.
+// if in.timestamp_window is set, timestamps that are further than that many seconds from now are handled
+// according to in.timestamp_policy: drop them, clamp them into the window, or pass them on (but still count them).
+// lines with a value or timestamp we can't parse at all are rejected, like lines without 3 fields.
+// a rejected or dropped line is counted, but neither indexed nor forwarded.
+
+// sampler prints at most one message per second, so that verbose mode stays readable under a flood of bad input
+type sampler struct {
+	last int64
+}
+
+func (s *sampler) sample(format string, a ...interface{}) {
+	if !isVerbose() {
+		return
+	}
+	now := time.Now().Unix()
+	last := atomic.LoadInt64(&s.last)
+	if now > last && atomic.CompareAndSwapInt64(&s.last, last, now) {
+		fmt.Printf(format, a...)
+	}
+}
+
+var valueSampler, tsSampler sampler
+
+func validPolicy(policy string, options ...string) bool {
+	for _, o := range options {
+		if policy == o {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTimestamp parses a timestamp without allocating. a fractional part is truncated, like carbon does.
+func parseTimestamp(b []byte) (int64, bool) {
+	if i := bytes.IndexByte(b, '.'); i >= 0 {
+		for _, c := range b[i+1:] {
+			if c < '0' || c > '9' {
+				return 0, false
+			}
+		}
+		whole := b[:i]
+		if len(whole) == 0 || (len(whole) == 1 && whole[0] == '-') {
+			// ".5" is 0, but "." is nothing
+			return 0, i+1 < len(b)
+		}
+		b = whole
+	}
+	if len(b) == 0 || len(b) > 18 {
+		return 0, false
+	}
+	neg := b[0] == '-'
+	if neg {
+		b = b[1:]
+		if len(b) == 0 {
+			return 0, false
+		}
+	}
+	var ts int64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		ts = ts*10 + int64(c-'0')
+	}
+	if neg {
+		ts = -ts
+	}
+	return ts, true
+}
+
+// checkValue tells whether a value is a float, and whether it is finite.
+// plain decimals, which is what we nearly always get, are checked without allocating:
+// with at most maxPlainDigits digits, they can't overflow a float64.
+// anything else (exponents, nan, inf, very long numbers) goes through strconv.ParseFloat.
+func checkValue(b []byte) (valid, finite bool) {
+	const maxPlainDigits = 300
+	i := 0
+	if i < len(b) && (b[i] == '-' || b[i] == '+') {
+		i++
+	}
+	digits := 0
+	for ; i < len(b) && b[i] >= '0' && b[i] <= '9'; i++ {
+		digits++
+	}
+	if i < len(b) && b[i] == '.' {
+		i++
+		for ; i < len(b) && b[i] >= '0' && b[i] <= '9'; i++ {
+			digits++
+		}
+	}
+	if i == len(b) && digits > 0 && digits <= maxPlainDigits {
+		return true, true
+	}
+	val, err := strconv.ParseFloat(string(b), 64)
+	if err != nil && !isRangeError(err) {
+		return false, false
+	}
+	return true, !math.IsNaN(val) && !math.IsInf(val, 0)
+}
+
+// validateLine checks the value and timestamp of a line, given its fields.
+// it returns the line to process (which has a different timestamp when clamped) and whether to process it at all.
+func validateLine(buf []byte, fields [3][]byte) ([]byte, bool) {
+	valid, finite := checkValue(fields[1])
+	if !valid {
+		valueSampler.sample("invalid value in line '%s'\n", trimLine(buf))
+		in_value_bad_total.Inc(1)
+		return buf, false
+	}
+	if !finite && *in_nonfinite == "drop" {
+		valueSampler.sample("dropping non-finite value in line '%s'\n", trimLine(buf))
+		in_value_bad_total.Inc(1)
+		return buf, false
+	}
+	ts, ok := parseTimestamp(fields[2])
+	if !ok {
+		tsSampler.sample("invalid timestamp in line '%s'\n", trimLine(buf))
+		in_ts_bad_total.Inc(1)
+		return buf, false
+	}
+	if *in_ts_window == 0 {
+		return buf, true
+	}
+	now := time.Now().Unix()
+	window := int64(*in_ts_window)
+	if ts >= now-window && ts <= now+window {
+		return buf, true
+	}
+	in_ts_bad_total.Inc(1)
+	switch *in_ts_policy {
+	case "drop":
+		tsSampler.sample("dropping line with timestamp outside of window: '%s'\n", trimLine(buf))
+		return buf, false
+	case "clamp":
+		tsSampler.sample("clamping timestamp outside of window: '%s'\n", trimLine(buf))
+		if ts < now-window {
+			ts = now - window
+		} else {
+			ts = now + window
+		}
+		clamped := make([]byte, 0, len(buf))
+		clamped = append(clamped, fields[0]...)
+		clamped = append(clamped, ' ')
+		clamped = append(clamped, fields[1]...)
+		clamped = append(clamped, ' ')
+		clamped = strconv.AppendInt(clamped, ts, 10)
+		clamped = append(clamped, '\n')
+		return clamped, true
+	}
+	tsSampler.sample("passing on timestamp outside of window: '%s'\n", trimLine(buf))
+	return buf, true
+}
+
+// isRangeError tells whether ParseFloat only failed because the value is out of range,
+// in which case it returns +/-Inf, which we treat as any other non-finite value.
+func isRangeError(err error) bool {
+	numErr, ok := err.(*strconv.NumError)
+	return ok && numErr.Err == strconv.ErrRange
+}
+
+func trimLine(buf []byte) []byte {
+	for len(buf) > 0 && (buf[len(buf)-1] == '\n' || buf[len(buf)-1] == '\r') {
+		buf = buf[:len(buf)-1]
+	}
+	return buf
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	cases := []struct {
+		in string
+		ts int64
+		ok bool
+	}{
+		{"1434000000", 1434000000, true},
+		{"0", 0, true},
+		{"-5", -5, true},
+		{"1434000000.25", 1434000000, true},
+		{"1434000000.999", 1434000000, true},
+		{"1434000000.", 1434000000, true},
+		{".5", 0, true},
+		{"-1.5", -1, true},
+		{"", 0, false},
+		{"-", 0, false},
+		{".", 0, false},
+		{"-.", 0, false},
+		{"1434000000.2.5", 0, false},
+		{"1434000000.x", 0, false},
+		{"1434000000x", 0, false},
+		{"1.4e9", 0, false},
+		{"+1434000000", 0, false},
+		{"nan", 0, false},
+		{"1234567890123456789", 0, false},
+	}
+	for _, c := range cases {
+		ts, ok := parseTimestamp([]byte(c.in))
+		if ok != c.ok || (ok && ts != c.ts) {
+			t.Errorf("parseTimestamp(%q) = %d, %v, want %d, %v", c.in, ts, ok, c.ts, c.ok)
+		}
+	}
+}
+
+func TestCheckValue(t *testing.T) {
+	cases := []struct {
+		in            string
+		valid, finite bool
+	}{
+		{"1", true, true},
+		{"-1", true, true},
+		{"+1", true, true},
+		{"1.5", true, true},
+		{"1.", true, true},
+		{".5", true, true},
+		{"-.5", true, true},
+		{"0.000001", true, true},
+		{"1e9", true, true},
+		{"1.5E-3", true, true},
+		{"1e400", true, false},
+		{"-1e400", true, false},
+		{"NaN", true, false},
+		{"nan", true, false},
+		{"Inf", true, false},
+		{"-inf", true, false},
+		{"+Infinity", true, false},
+		{"", false, false},
+		{"-", false, false},
+		{".", false, false},
+		{"1.2.3", false, false},
+		{"1,5", false, false},
+		{"0x10", false, false},
+		{"1e", false, false},
+		{"abc", false, false},
+		{"1 ", false, false},
+	}
+	for _, c := range cases {
+		valid, finite := checkValue([]byte(c.in))
+		if valid != c.valid || finite != c.finite {
+			t.Errorf("checkValue(%q) = %v, %v, want %v, %v", c.in, valid, finite, c.valid, c.finite)
+		}
+	}
+}
+
+// checkValue must agree with strconv.ParseFloat, which we used to call for every value
+func TestCheckValueMatchesParseFloat(t *testing.T) {
+	values := []string{"0", "-0", "123456789012345678901234567890", "3.14159", "-2.5", "1e308", "1e309", "007", "1_000", "0x1p-2", "infinity", "inf5"}
+	long := "1"
+	for i := 0; i < 400; i++ {
+		long += "0"
+	}
+	values = append(values, long, long+".5", "0."+long)
+	for _, v := range values {
+		f, err := strconv.ParseFloat(v, 64)
+		wantValid := err == nil || isRangeError(err)
+		wantFinite := wantValid && !math.IsNaN(f) && !math.IsInf(f, 0)
+		valid, finite := checkValue([]byte(v))
+		if valid != wantValid || finite != wantFinite {
+			t.Errorf("checkValue(%q) = %v, %v, ParseFloat says %v, %v", v, valid, finite, wantValid, wantFinite)
+		}
+	}
+}
+
+func TestCheckValueAllocs(t *testing.T) {
+	for _, v := range []string{"1", "-12.5", "1434000000.123456", "99999999999999999999999999999999999999999.5"} {
+		b := []byte(v)
+		allocs := testing.AllocsPerRun(100, func() {
+			checkValue(b)
+		})
+		if allocs != 0 {
+			t.Errorf("checkValue(%q) allocates %v times", v, allocs)
+		}
+	}
+}
+
+// valid lines are forwarded, even if their metric id is invalid. rejected and dropped lines are not.
+func TestForwardValidLinesOnly(t *testing.T) {
+	dest := testDestinations("10.0.0.1:2003")[0]
+	dest.queue = make(chan []byte, 100)
+	defer func(orig []*destination) { destinations = orig }(destinations)
+	destinations = []*destination{dest}
+	defer func(orig int) { *in_ts_window = orig }(*in_ts_window)
+	*in_ts_window = 600
+
+	now := time.Now().Unix()
+	good := []string{
+		fmt.Sprintf("a.b.c 1 %d\n", now),
+		fmt.Sprintf("unit_is_B.what_is_mem 1.5 %d\n", now),
+		fmt.Sprintf("a..b 1 %d.5\n", now),
+	}
+	bad := []string{
+		"a.b.c 1\n",
+		fmt.Sprintf("a.b.c 1 %d extra\n", now),
+		fmt.Sprintf("a.b.c one %d\n", now),
+		fmt.Sprintf("a.b.c nan %d\n", now),
+		"a.b.c 1 yesterday\n",
+		fmt.Sprintf("a.b.c 1 %d\n", now-3600),
+	}
+	for _, line := range append(bad, good...) {
+		processLine([]byte(line), nil, nil)
+	}
+	var got []string
+	for len(dest.queue) > 0 {
+		got = append(got, string(<-dest.queue))
+	}
+	equalLines(t, "forwarded", got, good)
+}
+
+func TestValidateLine(t *testing.T) {
+	defer func(nonfinite, policy string, window int) {
+		*in_nonfinite, *in_ts_policy, *in_ts_window = nonfinite, policy, window
+	}(*in_nonfinite, *in_ts_policy, *in_ts_window)
+	now := time.Now().Unix()
+	cases := []struct {
+		nonfinite, policy string
+		window            int
+		line              string
+		want              string // the line to process, "" if it's rejected
+	}{
+		{"drop", "drop", 0, "a.b 1.5 1434000000", "a.b 1.5 1434000000"},
+		{"drop", "drop", 0, "a.b -1e400 1434000000", ""},
+		{"drop", "drop", 0, "a.b NaN 1434000000", ""},
+		{"pass", "drop", 0, "a.b NaN 1434000000", "a.b NaN 1434000000"},
+		{"pass", "drop", 0, "a.b x 1434000000", ""},
+		{"drop", "drop", 0, "a.b 1 1434000000x", ""},
+		{"drop", "drop", 600, fmt.Sprintf("a.b 1 %d", now-60), fmt.Sprintf("a.b 1 %d", now-60)},
+		{"drop", "drop", 600, fmt.Sprintf("a.b 1 %d", now-3600), ""},
+		{"drop", "pass", 600, fmt.Sprintf("a.b 1 %d", now-3600), fmt.Sprintf("a.b 1 %d", now-3600)},
+		{"drop", "clamp", 600, fmt.Sprintf("a.b 1 %d", now-3600), fmt.Sprintf("a.b 1 %d", now-600)},
+		{"drop", "clamp", 600, fmt.Sprintf("a.b 1 %d", now+3600), fmt.Sprintf("a.b 1 %d", now+600)},
+	}
+	for _, c := range cases {
+		*in_nonfinite, *in_ts_policy, *in_ts_window = c.nonfinite, c.policy, c.window
+		buf := []byte(c.line + "\n")
+		fields, _ := splitLine(buf[:len(buf)-1])
+		line, ok := validateLine(buf, fields)
+		if ok != (c.want != "") || (ok && string(line) != c.want+"\n") {
+			t.Errorf("%s with %s/%s/%d gives %q, %v, want %q", c.line, c.nonfinite, c.policy, c.window, line, ok, c.want)
+		}
+	}
+}
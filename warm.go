@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	m20 "github.com/metrics20/go-metrics20"
+	elastigo "github.com/vimeo/carbon-tagger/_third_party/github.com/mattbaird/elastigo/lib"
+	"time"
+)
+
+// warming of the trackers' seen caches with the ids that are already in the index, so that a restart doesn't
+// resubmit every metric. we scroll through the index and hand the ids to the trackers, which add them to their
+// seen caches in between processing incoming metrics. with elasticsearch.warm_cache = block, we only start
+// accepting traffic once that's done. warming stops after warm_timeout seconds or warm_max_ids ids,
+// and if ES can't be reached, we just go without.
+
+const scrollPageSize = 5000
+
+// warmSeen scrolls through the index and sends all ids to the trackers. it closes done when it's finished.
+func warmSeen(conn *elastigo.Conn, index string, timeout time.Duration, maxIds int, done chan struct{}) {
+	defer close(done)
+	warmed1 := NewCounter("unit_is_Metric.proto_is_1.type_is_warmed", false)
+	warmed2 := NewCounter("unit_is_Metric.proto_is_2.type_is_warmed", false)
+	failed := NewCounter("unit_is_Err.orig_unit_is_Req.type_is_warm_failed", false)
+	duration := NewGauge("unit_is_ms.type_is_warm_duration", false)
+
+	pre := time.Now()
+	deadline := pre.Add(timeout)
+	total := 0
+	err := scrollIds(conn, index, func(ids []string, inIndex int) bool {
+		var ids1, ids2 []string
+		for _, id := range ids {
+			if isTaggedSeries(id) || m20.IsMetric20(id) {
+				ids2 = append(ids2, id)
+			} else {
+				ids1 = append(ids1, id)
+			}
+		}
+		if len(ids1) > 0 {
+			if !warmShards(proto1_shards, ids1) {
+				return false
+			}
+			warmed1.Inc(int64(len(ids1)))
+		}
+		if len(ids2) > 0 {
+			if !warmShards(proto2_shards, ids2) {
+				return false
+			}
+			warmed2.Inc(int64(len(ids2)))
+		}
+		total += len(ids)
+		if maxIds > 0 && total >= maxIds {
+			fmt.Printf("WARN warming stopped after reaching elasticsearch.warm_max_ids. %d ids of %d loaded\n", total, inIndex)
+			return false
+		}
+		if time.Now().After(deadline) {
+			fmt.Printf("WARN warming stopped after elasticsearch.warm_timeout of %s. %d ids of %d loaded\n", timeout, total, inIndex)
+			return false
+		}
+		return !isDraining()
+	})
+	dur := time.Since(pre)
+	duration.Update(int64(dur / time.Millisecond))
+	if err != nil {
+		failed.Inc(1)
+		fmt.Printf("WARN can't warm seen caches from ES: %s. continuing with %d ids\n", err.Error(), total)
+		return
+	}
+	fmt.Printf("warmed seen caches with %d ids from ES in %s\n", total, dur)
+}
+
+// scrollIds scrolls through the ids of all metrics in the index, and hands them to fn, a page at a time,
+// along with the number of metrics in the index. it stops when fn returns false.
+func scrollIds(conn *elastigo.Conn, index string, fn func(ids []string, inIndex int) bool) error {
+	args := map[string]interface{}{"scroll": "1m", "size": scrollPageSize}
+	query := map[string]interface{}{
+		"fields": []string{}, // we only need the ids
+		"query":  map[string]interface{}{"match_all": map[string]interface{}{}},
+	}
+	res, err := conn.Search(index, "metric", args, query)
+	for err == nil && len(res.Hits.Hits) > 0 {
+		ids := make([]string, len(res.Hits.Hits))
+		for i, hit := range res.Hits.Hits {
+			ids[i] = hit.Id
+		}
+		if !fn(ids, res.Hits.Total) {
+			return nil
+		}
+		res, err = conn.Scroll(map[string]interface{}{"scroll": "1m"}, res.ScrollId)
+	}
+	return err
+}
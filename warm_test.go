@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	elastigo "github.com/vimeo/carbon-tagger/_third_party/github.com/mattbaird/elastigo/lib"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeES serves handler as elasticsearch, and returns a connection to it
+func fakeES(t *testing.T, handler http.HandlerFunc) (*elastigo.Conn, *httptest.Server) {
+	srv := httptest.NewServer(handler)
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := elastigo.NewConn()
+	conn.Domain = host
+	conn.SetPort(port)
+	return conn, srv
+}
+
+// searchResult is a page of search results, holding only ids
+func searchResult(scrollId string, total int, ids ...string) string {
+	var hits []string
+	for _, id := range ids {
+		hits = append(hits, fmt.Sprintf(`{"_index":"metrics","_type":"metric","_id":"%s"}`, id))
+	}
+	return fmt.Sprintf(`{"_scroll_id":"%s","hits":{"total":%d,"hits":[%s]}}`, scrollId, total, strings.Join(hits, ","))
+}
+
+func TestWarmSeen(t *testing.T) {
+	pages := []string{
+		searchResult("s1", 5, "a.b.c", "unit_is_B.what_is_mem", "d.e.f"),
+		searchResult("s2", 5, "disk.used;unit=B", "g.h.i"),
+		searchResult("s3", 5),
+	}
+	var paths []string
+	var lock sync.Mutex
+	conn, srv := fakeES(t, func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		paths = append(paths, r.URL.Path)
+		fmt.Fprint(w, pages[0])
+		pages = pages[1:]
+	})
+	defer srv.Close()
+
+	defer func(orig1, orig2 []*trackerShard) { proto1_shards, proto2_shards = orig1, orig2 }(proto1_shards, proto2_shards)
+	proto1_shards, proto2_shards = benchShards(1, 2), benchShards(2, 1)
+	done := make(chan struct{})
+	go warmSeen(conn, "metrics", time.Minute, 100, done)
+	var ids1, ids2 []string
+	for running := true; running; {
+		select {
+		case ids := <-proto1_shards[0].warm:
+			ids1 = append(ids1, ids...)
+		case ids := <-proto1_shards[1].warm:
+			ids1 = append(ids1, ids...)
+		case ids := <-proto2_shards[0].warm:
+			ids2 = append(ids2, ids...)
+		case <-done:
+			running = false
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for warming to finish")
+		}
+	}
+	sort.Strings(ids1)
+	sort.Strings(ids2)
+	if strings.Join(ids1, " ") != "a.b.c d.e.f g.h.i" || strings.Join(ids2, " ") != "disk.used;unit=B unit_is_B.what_is_mem" {
+		t.Errorf("warmed proto1 with %v and proto2 with %v", ids1, ids2)
+	}
+	want := "/metrics/metric/_search /_search/scroll /_search/scroll"
+	lock.Lock()
+	defer lock.Unlock()
+	if strings.Join(paths, " ") != want {
+		t.Errorf("requested %v, want %s", paths, want)
+	}
+}
+
+// once the trackers have returned, warming gives up instead of waiting for them forever
+func TestWarmShardsStopped(t *testing.T) {
+	shards := benchShards(1, 2)
+	close(shards[1].done)
+	var ids []string
+	for i := 0; i < 10; i++ {
+		ids = append(ids, fmt.Sprintf("a.b%d", i))
+	}
+	go func() {
+		// the shard whose tracker is still running
+		for range shards[0].warm {
+		}
+	}()
+	result := make(chan bool)
+	go func() {
+		result <- warmShards(shards, ids)
+	}()
+	select {
+	case ok := <-result:
+		if ok {
+			t.Error("warmShards handed ids to a stopped tracker")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("warmShards hangs on a stopped tracker")
+	}
+	close(shards[0].warm)
+}